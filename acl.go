@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNoAuth = errors.New("NOAUTH Authentication required.")
+var ErrNoKeyPermission = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+var ErrDefaultUserRemoval = errors.New("ERR The 'default' user cannot be removed")
+var ErrInvalidUsername = errors.New("ERR Usernames can't contain spaces, newlines or special characters")
+var ErrNoACLFile = errors.New("ERR This instance is not configured to use an ACL file, set the aclfile directive to load and save users")
+
+// aclCategories are the command categories which can be used in rules like +@write,
+// a command belongs to a category when it has the matching flag. @all is every command.
+var aclCategories = map[string]CommandFlag{
+	"write":    CommandFlagWrite,
+	"readonly": CommandFlagReadonly,
+	"admin":    CommandFlagAdmin,
+	"fast":     CommandFlagFast,
+	"pubsub":   CommandFlagPubSub,
+}
+
+// aclUser is what a connection is allowed to do once authenticated
+type aclUser struct {
+	name    string
+	enabled bool
+	// nopass users accept any password
+	nopass bool
+	// passwords are SHA-256 hashes in hexadecimal
+	passwords []string
+	// commands are the names of the commands the user can run, as in commandMap
+	commands map[string]bool
+	// allKeys is set by ~* and allkeys, otherwise keys must match one of keyPatterns
+	allKeys     bool
+	keyPatterns []string
+}
+
+// newACLUser creates a user which is disabled and cannot run any command, the same way
+// ACL SETUSER does for unknown users
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:     name,
+		commands: map[string]bool{},
+	}
+}
+
+// newDefaultACLUser creates the user new connections are authenticated as, until rules
+// say otherwise it can do anything without a password
+func newDefaultACLUser() *aclUser {
+	u := newACLUser("default")
+	u.enabled = true
+	u.nopass = true
+	u.allKeys = true
+	u.setCommands(true, func(command) bool { return true })
+	return u
+}
+
+func (u *aclUser) clone() *aclUser {
+	clone := *u
+	clone.passwords = append([]string{}, u.passwords...)
+	clone.keyPatterns = append([]string{}, u.keyPatterns...)
+	clone.commands = map[string]bool{}
+	for name := range u.commands {
+		clone.commands[name] = true
+	}
+	return &clone
+}
+
+func hashPassword(password []byte) string {
+	hash := sha256.Sum256(password)
+	return hex.EncodeToString(hash[:])
+}
+
+func isValidPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if !isHexDigit(hash[i]) || (hash[i] >= 'A' && hash[i] <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *aclUser) addPasswordHash(hash string) {
+	u.nopass = false
+	for _, existing := range u.passwords {
+		if existing == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePasswordHash(hash string) error {
+	for i, existing := range u.passwords {
+		if existing == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("The password you are trying to remove from the user does not exist")
+}
+
+// setCommands allows or denies every command for which match returns true
+func (u *aclUser) setCommands(allowed bool, match func(command) bool) {
+	for _, cmd := range commandMap {
+		if !match(cmd) {
+			continue
+		}
+		if allowed {
+			u.commands[cmd.name] = true
+		} else {
+			delete(u.commands, cmd.name)
+		}
+	}
+}
+
+// applyRule changes the user according to a single ACL rule:
+//
+//	on, off                  enable or disable the user
+//	>password, <password     add or remove a password
+//	#hash, !hash             add or remove a password by its SHA-256 hash
+//	nopass, resetpass        accept any password, or remove every password
+//	~pattern, allkeys        allow the keys matching a glob pattern, or every key
+//	resetkeys                forget the key patterns
+//	+command, -command       allow or deny a command
+//	+@category, -@category   allow or deny a category of commands, @all is every command
+//	allcommands, nocommands  the same as +@all and -@all
+//	reset                    go back to a new user which cannot do anything
+func (u *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys" || rule == "~*":
+		u.allKeys = true
+		u.keyPatterns = nil
+	case lower == "resetkeys":
+		u.allKeys = false
+		u.keyPatterns = nil
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case lower == "reset":
+		*u = *newACLUser(u.name)
+	case len(rule) == 0:
+		return errors.New("Syntax error")
+	case rule[0] == '>':
+		u.addPasswordHash(hashPassword([]byte(rule[1:])))
+	case rule[0] == '<':
+		return u.removePasswordHash(hashPassword([]byte(rule[1:])))
+	case rule[0] == '#' || rule[0] == '!':
+		hash := rule[1:]
+		if !isValidPasswordHash(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if rule[0] == '!' {
+			return u.removePasswordHash(hash)
+		}
+		u.addPasswordHash(hash)
+	case rule[0] == '~':
+		if u.allKeys {
+			return errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+		}
+		u.keyPatterns = append(u.keyPatterns, rule[1:])
+	case rule[0] == '+' || rule[0] == '-':
+		allowed := rule[0] == '+'
+		name := lower[1:]
+		if name == "@all" {
+			u.setCommands(allowed, func(command) bool { return true })
+		} else if flag, ok := aclCategories[strings.TrimPrefix(name, "@")]; ok && name[0] == '@' {
+			u.setCommands(allowed, func(cmd command) bool { return cmd.hasFlag(flag) })
+		} else if cmd, ok := commandMap[strings.ToUpper(name)]; ok {
+			u.setCommands(allowed, func(other command) bool { return other.name == cmd.name })
+		} else {
+			return errors.New("Unknown command or category name in ACL")
+		}
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) canAccessKey(key []byte) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keyPatterns {
+		if globMatch([]byte(pattern), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeCommands lists the commands the user can run as rules, starting from +@all
+// or -@all depending on which one needs fewer exceptions
+func (u *aclUser) describeCommands() []string {
+	allowed := []string{}
+	denied := []string{}
+	for _, cmd := range commandMap {
+		if u.commands[cmd.name] {
+			allowed = append(allowed, "+"+cmd.name)
+		} else {
+			denied = append(denied, "-"+cmd.name)
+		}
+	}
+	sort.Strings(allowed)
+	sort.Strings(denied)
+
+	if len(allowed) > len(denied) {
+		return append([]string{"+@all"}, denied...)
+	}
+	return append([]string{"-@all"}, allowed...)
+}
+
+// describe lists the rules which create the user, the same way ACL LIST does
+func (u *aclUser) describe() []string {
+	rules := []string{"off"}
+	if u.enabled {
+		rules[0] = "on"
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	if u.allKeys {
+		rules = append(rules, "~*")
+	}
+	for _, pattern := range u.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return append(rules, u.describeCommands()...)
+}
+
+// aclRegistry holds the users, a connection keeps a pointer to its user so changes made
+// by ACL SETUSER apply to the connections already authenticated with it
+type aclRegistry struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	// file is the ACL file users are loaded from and saved to, empty when there is none
+	file string
+}
+
+func newACLRegistry() *aclRegistry {
+	return &aclRegistry{
+		users: map[string]*aclUser{"default": newDefaultACLUser()},
+	}
+}
+
+var acl *aclRegistry
+
+func init() {
+	// ACL refers to commandMap, like COMMAND its handler is set once commandMap exists
+	cmd := commandMap["ACL"]
+	cmd.handler = aclCommand
+	commandMap["ACL"] = cmd
+	acl = newACLRegistry()
+}
+
+// initialUser is the user new connections are authenticated as, nil when the default
+// user requires a password and connections must authenticate first
+func (a *aclRegistry) initialUser() *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users["default"]
+	if u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// defaultUserNoPass tells whether the default user accepts any password
+func (a *aclRegistry) defaultUserNoPass() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users["default"].nopass
+}
+
+func (a *aclRegistry) authenticate(username, password []byte) (*aclUser, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[string(username)]
+	if !ok || !u.enabled {
+		return nil, ErrWrongPass
+	}
+	if u.nopass {
+		return u, nil
+	}
+	hash := []byte(hashPassword(password))
+	for _, existing := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(existing)) == 1 {
+			return u, nil
+		}
+	}
+	return nil, ErrWrongPass
+}
+
+// checkPermission tells whether u, nil for a connection which did not authenticate,
+// can run cmd with the given arguments
+func (a *aclRegistry) checkPermission(u *aclUser, cmd command, args [][]byte) error {
+	if cmd.hasFlag(CommandFlagNoAuth) {
+		return nil
+	}
+	if u == nil {
+		return ErrNoAuth
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !u.commands[cmd.name] {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command or its subcommand", cmd.name)
+	}
+	for _, key := range cmd.keyArgs(args) {
+		if !u.canAccessKey(key) {
+			return ErrNoKeyPermission
+		}
+	}
+	return nil
+}
+
+// username reads the name of u, which setUser may be rewriting
+func (a *aclRegistry) username(u *aclUser) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return u.name
+}
+
+// setUser applies rules to the user, creating it if needed. Either every rule is
+// applied or none is.
+func (a *aclRegistry) setUser(name string, rules []string) error {
+	if !isValidClientName([]byte(name)) {
+		return ErrInvalidUsername
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	existing, ok := a.users[name]
+	u := newACLUser(name)
+	if ok {
+		u = existing.clone()
+	}
+	for _, rule := range rules {
+		err := u.applyRule(rule)
+		if err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err.Error())
+		}
+	}
+
+	if ok {
+		*existing = *u
+	} else {
+		a.users[name] = u
+	}
+	return nil
+}
+
+func (a *aclRegistry) getUser(name string) (*aclUser, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// deleteUsers removes the users and returns the ones which existed, the connections
+// authenticated with them should be closed
+func (a *aclRegistry) deleteUsers(names []string) ([]*aclUser, error) {
+	for _, name := range names {
+		if name == "default" {
+			return nil, ErrDefaultUserRemoval
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleted := []*aclUser{}
+	for _, name := range names {
+		u, ok := a.users[name]
+		if ok {
+			delete(a.users, name)
+			deleted = append(deleted, u)
+		}
+	}
+	return deleted, nil
+}
+
+// usernames returns the name of every user, sorted
+func (a *aclRegistry) usernames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.sortedUsernames()
+}
+
+func (a *aclRegistry) sortedUsernames() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// list describes every user sorted by name, one ACL file line per user
+func (a *aclRegistry) list() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := a.sortedUsernames()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, "user "+name+" "+strings.Join(a.users[name].describe(), " "))
+	}
+	return lines
+}
+
+// parseACLFile reads an ACL file, each line is "user <name> <rule> ..." and lines
+// starting with # are comments. The default user is added when the file does not
+// define it.
+func parseACLFile(path string) (map[string]*aclUser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitArgs([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err.Error())
+		}
+		if len(args) < 2 || strings.ToLower(string(args[0])) != "user" {
+			return nil, fmt.Errorf("%s:%d: line should start with user keyword followed by the username", path, lineNumber)
+		}
+		name := string(args[1])
+		if !isValidClientName(args[1]) {
+			return nil, fmt.Errorf("%s:%d: invalid username '%s'", path, lineNumber, name)
+		}
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s'", path, lineNumber, name)
+		}
+
+		u := newACLUser(name)
+		for _, rule := range args[2:] {
+			err = u.applyRule(string(rule))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: '%s': %s", path, lineNumber, rule, err.Error())
+			}
+		}
+		users[name] = u
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := users["default"]; !ok {
+		users["default"] = newDefaultACLUser()
+	}
+	return users, nil
+}
+
+// load replaces every user with the ones from the ACL file, nothing changes if the file
+// has an error. Users which are not in the file anymore are returned so their
+// connections can be closed.
+func (a *aclRegistry) load() ([]*aclUser, error) {
+	if a.file == "" {
+		return nil, ErrNoACLFile
+	}
+	users, err := parseACLFile(a.file)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	removed := []*aclUser{}
+	for name, existing := range a.users {
+		u, ok := users[name]
+		if !ok {
+			removed = append(removed, existing)
+			continue
+		}
+		*existing = *u
+		users[name] = existing
+	}
+	a.users = users
+	return removed, nil
+}
+
+// save writes every user to the ACL file, replacing it atomically
+func (a *aclRegistry) save() error {
+	if a.file == "" {
+		return ErrNoACLFile
+	}
+	content := strings.Join(a.list(), "\n") + "\n"
+	tmp := a.file + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(content), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
+
+// closeUserClients disconnects the clients authenticated with one of the users
+func closeUserClients(users []*aclUser) {
+	if len(users) == 0 {
+		return
+	}
+	srv.closeClients(func(c *client) bool {
+		user := c.currentUser()
+		for _, u := range users {
+			if user == u {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func auth(c *client, args [][]byte) (interface{}, error) {
+	if len(args) > 3 {
+		return nil, ErrSyntax
+	}
+	username, password := []byte("default"), args[1]
+	if len(args) == 3 {
+		username, password = args[1], args[2]
+	} else if acl.defaultUserNoPass() {
+		return nil, errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	u, err := acl.authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	c.setUser(u)
+	return "OK", nil
+}
+
+func aclCommand(c *client, args [][]byte) (interface{}, error) {
+	subcommand := strings.ToUpper(string(args[1]))
+	switch {
+	case subcommand == "SETUSER" && len(args) >= 3:
+		rules := []string{}
+		for _, rule := range args[3:] {
+			rules = append(rules, string(rule))
+		}
+		err := acl.setUser(string(args[2]), rules)
+		if err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	case subcommand == "GETUSER" && len(args) == 3:
+		u, ok := acl.getUser(string(args[2]))
+		if !ok {
+			return nil, nil
+		}
+		return describeACLUser(u), nil
+	case subcommand == "DELUSER" && len(args) >= 3:
+		names := []string{}
+		for _, name := range args[2:] {
+			names = append(names, string(name))
+		}
+		deleted, err := acl.deleteUsers(names)
+		if err != nil {
+			return nil, err
+		}
+		closeUserClients(deleted)
+		return len(deleted), nil
+	case subcommand == "LIST" && len(args) == 2:
+		lines := [][]byte{}
+		for _, line := range acl.list() {
+			lines = append(lines, []byte(line))
+		}
+		return lines, nil
+	case subcommand == "USERS" && len(args) == 2:
+		names := [][]byte{}
+		for _, name := range acl.usernames() {
+			names = append(names, []byte(name))
+		}
+		return names, nil
+	case subcommand == "WHOAMI" && len(args) == 2:
+		return []byte(acl.username(c.currentUser())), nil
+	case subcommand == "CAT" && len(args) == 2:
+		categories := [][]byte{}
+		for category := range aclCategories {
+			categories = append(categories, []byte(category))
+		}
+		sort.Slice(categories, func(i, j int) bool { return string(categories[i]) < string(categories[j]) })
+		return categories, nil
+	case subcommand == "CAT" && len(args) == 3:
+		flag, ok := aclCategories[strings.ToLower(string(args[2]))]
+		if !ok {
+			return nil, fmt.Errorf("ERR Unknown category '%s'", args[2])
+		}
+		names := []string{}
+		for _, cmd := range commandMap {
+			if cmd.hasFlag(flag) {
+				names = append(names, cmd.name)
+			}
+		}
+		sort.Strings(names)
+		commands := [][]byte{}
+		for _, name := range names {
+			commands = append(commands, []byte(name))
+		}
+		return commands, nil
+	case subcommand == "LOAD" && len(args) == 2:
+		removed, err := acl.load()
+		if err != nil {
+			return nil, errors.New("ERR Error loading the ACL file: " + err.Error())
+		}
+		closeUserClients(removed)
+		return "OK", nil
+	case subcommand == "SAVE" && len(args) == 2:
+		err := acl.save()
+		if err != nil {
+			return nil, errors.New("ERR Error saving the ACL file: " + err.Error())
+		}
+		return "OK", nil
+	}
+	return nil, fmt.Errorf("ERR Unknown subcommand or wrong number of arguments for '%s'", args[1])
+}
+
+// describeACLUser is the ACL GETUSER reply
+func describeACLUser(u *aclUser) respMap {
+	flags := respSet{}
+	if u.enabled {
+		flags = append(flags, "on")
+	} else {
+		flags = append(flags, "off")
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	if len(u.commands) == len(commandMap) {
+		flags = append(flags, "allcommands")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+
+	passwords := [][]byte{}
+	for _, hash := range u.passwords {
+		passwords = append(passwords, []byte(hash))
+	}
+	keyPatterns := [][]byte{}
+	for _, pattern := range u.keyPatterns {
+		keyPatterns = append(keyPatterns, []byte(pattern))
+	}
+
+	return respMap{
+		{"flags", flags},
+		{"passwords", passwords},
+		{"commands", []byte(strings.Join(u.describeCommands(), " "))},
+		{"keys", keyPatterns},
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestACLSetUser(t *testing.T) {
+	testCases := []struct {
+		title    string
+		rules    string
+		expected string
+		err      bool
+	}{
+		{"new user", "", "user alice off -@all", false},
+		{"enabled with password", "on >secret", "user alice on #2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b -@all", false},
+		{"password removal", ">secret <secret nopass", "user alice off nopass -@all", false},
+		{"missing password removal", "<secret", "", true},
+		{"key patterns", "~cache:* ~queue:*", "user alice off ~cache:* ~queue:* -@all", false},
+		{"pattern after allkeys", "allkeys ~queue:*", "", true},
+		{"category", "+@readonly -keys", "user alice off -@all +get +lindex +llen +lpos +lrange +object", false},
+		{"every command but one", "+@all -shutdown", "user alice off +@all -shutdown", false},
+		{"unknown command", "+nosuchcommand", "", true},
+		{"unknown category", "+@nosuchcategory", "", true},
+		{"reset", "on nopass ~* +@all reset", "user alice off -@all", false},
+		{"invalid hash", "#abc", "", true},
+	}
+
+	for _, testCase := range testCases {
+		registry := newACLRegistry()
+		err := registry.setUser("alice", strings.Fields(testCase.rules))
+		if (err != nil) != testCase.err {
+			t.Fatalf("Case \"%s\":\n Expected error=%v\n Actual error=%v", testCase.title, testCase.err, err)
+		}
+		if testCase.err {
+			if _, ok := registry.getUser("alice"); ok {
+				t.Fatalf("Case \"%s\":\n Expected the user not to be created", testCase.title)
+			}
+			continue
+		}
+
+		lines := registry.list()
+		if len(lines) != 2 || lines[0] != testCase.expected {
+			t.Fatalf("Case \"%s\":\n Expected %q\n Actual %q", testCase.title, testCase.expected, lines)
+		}
+	}
+}
+
+func TestACLCheckPermission(t *testing.T) {
+	registry := newACLRegistry()
+	err := registry.setUser("reader", []string{"on", ">pass", "~cache:*", "+@readonly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := registry.authenticate([]byte("reader"), []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		title   string
+		user    *aclUser
+		command string
+		allowed bool
+	}{
+		{"readonly command on allowed key", reader, "GET cache:1", true},
+		{"readonly command on other key", reader, "GET session:1", false},
+		{"write command", reader, "SET cache:1 value", false},
+		{"command without keys", reader, "KEYS *", true},
+		{"admin command", reader, "SHUTDOWN", false},
+		{"not authenticated", nil, "GET cache:1", false},
+		{"AUTH before authenticating", nil, "AUTH reader pass", true},
+		{"HELLO before authenticating", nil, "HELLO 3 AUTH reader pass", true},
+	}
+
+	for _, testCase := range testCases {
+		args := [][]byte{}
+		for _, arg := range strings.Fields(testCase.command) {
+			args = append(args, []byte(arg))
+		}
+		cmd := commandMap[strings.ToUpper(string(args[0]))]
+		err := registry.checkPermission(testCase.user, cmd, args)
+		if (err == nil) != testCase.allowed {
+			t.Fatalf("Case \"%s\":\n Expected allowed=%v\n Actual error=%v", testCase.title, testCase.allowed, err)
+		}
+	}
+
+	_, err = registry.authenticate([]byte("reader"), []byte("wrong"))
+	if err != ErrWrongPass {
+		t.Fatalf("Expected %v for a wrong password, Actual %v", ErrWrongPass, err)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atossa-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := newACLRegistry()
+	registry.file = filepath.Join(dir, "users.acl")
+	registry.setUser("default", []string{">secret", "-shutdown"})
+	registry.setUser("alice", []string{"on", ">pass", "~queue:*", "+@write"})
+	registry.setUser("bob", []string{"on", "nopass", "+ping"})
+	bob, _ := registry.authenticate([]byte("bob"), nil)
+	err = registry.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := registry.list()
+
+	// bob is removed from the file, reloading must drop that user and keep the others
+	content, err := ioutil.ReadFile(registry.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	err = ioutil.WriteFile(registry.file, []byte("# users\n"+lines[0]+"\n"+lines[2]+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newACLRegistry()
+	reloaded.file = registry.file
+	removed, err := reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{saved[0], saved[2]}
+	if !reflect.DeepEqual(reloaded.list(), expected) || len(removed) != 0 {
+		t.Fatalf("Expected users=%q\n Actual users=%q, removed=%d", expected, reloaded.list(), len(removed))
+	}
+
+	removed, err = registry.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != bob {
+		t.Fatalf("Expected bob to be removed, Actual removed=%v", removed)
+	}
+
+	err = ioutil.WriteFile(registry.file, []byte("user alice on +nosuchcommand\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registry.load()
+	if err == nil || !reflect.DeepEqual(registry.list(), expected) {
+		t.Fatalf("Expected an invalid file to be rejected without changing the users, Actual err=%v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	badger "github.com/dgraph-io/badger/v2"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+var ErrTimeoutNegative = errors.New("ERR timeout is negative")
+
+// blockedClient is a client waiting in a blocking command for one of keys to be
+// written to
+type blockedClient struct {
+	c    *client
+	keys [][]byte
+	// ready is signaled when one of the keys was written to, the client then tries
+	// again and waits some more if another client got there first
+	ready chan struct{}
+}
+
+// blockingRegistry tracks the clients waiting on each key, in the order they started
+// waiting. A write to a key wakes its first waiter only, which wakes the next one once
+// it is done, so waiters are served in FIFO order.
+type blockingRegistry struct {
+	mu   sync.Mutex
+	keys map[string][]*blockedClient
+	// count is how many clients are blocked
+	count int
+}
+
+var blocking = &blockingRegistry{
+	keys: map[string][]*blockedClient{},
+}
+
+func (b *blockingRegistry) block(c *client, keys [][]byte) *blockedClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	waiter := &blockedClient{c: c, ready: make(chan struct{}, 1)}
+	for _, key := range keys {
+		queue := b.keys[string(key)]
+		if len(queue) > 0 && queue[len(queue)-1] == waiter {
+			// the same key given twice
+			continue
+		}
+		b.keys[string(key)] = append(queue, waiter)
+		waiter.keys = append(waiter.keys, key)
+	}
+	b.count++
+	return waiter
+}
+
+// unblock removes the waiter from the queues of its keys. The next waiters are woken
+// up in case the waiter consumed, or ignored, a wakeup meant for them.
+func (b *blockingRegistry) unblock(waiter *blockedClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range waiter.keys {
+		queue := b.keys[string(key)]
+		for i, other := range queue {
+			if other == waiter {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(b.keys, string(key))
+		} else {
+			b.keys[string(key)] = queue
+		}
+	}
+	b.count--
+	b.signalLocked(waiter.keys)
+}
+
+// signal wakes the first client waiting on each of keys up, it is called once writes to
+// the keys are committed
+func (b *blockingRegistry) signal(keys [][]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.signalLocked(keys)
+}
+
+func (b *blockingRegistry) signalLocked(keys [][]byte) {
+	for _, key := range keys {
+		queue := b.keys[string(key)]
+		if len(queue) == 0 {
+			continue
+		}
+		select {
+		case queue[0].ready <- struct{}{}:
+		default:
+			// already woken up
+		}
+	}
+}
+
+func (b *blockingRegistry) blockedCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// parseTimeout parses the timeout of a blocking command in seconds, 0 waits forever
+func parseTimeout(arg []byte) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, ErrTimeoutNotFloat
+	}
+	if seconds < 0 {
+		return 0, ErrTimeoutNegative
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// blockingPop runs pop in a new transaction until it returns a reply, waiting for
+// writes to keys in between so no transaction is open while the client waits.
+// timeoutReply is returned once timeout expires. Commands run by EXEC never wait.
+func blockingPop(c *client, keys [][]byte, timeout time.Duration, timeoutReply interface{}, pop func(txn *badger.Txn) (interface{}, error)) (interface{}, error) {
+	tryPop := func() (interface{}, error) {
+		var reply interface{}
+		err := update(c, func(txn *badger.Txn) error {
+			var err error
+			reply, err = pop(txn)
+			return err
+		})
+		return reply, err
+	}
+	if c.txn != nil {
+		reply, err := tryPop()
+		if err != nil || reply != nil {
+			return reply, err
+		}
+		return timeoutReply, nil
+	}
+
+	// Waiting starts before the first try, so a write committed right after it
+	// still wakes the client up
+	waiter := blocking.block(c, keys)
+	defer blocking.unblock(waiter)
+	aborted := c.beginBlocking()
+	defer c.endBlocking()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	disconnected, stopWatching := c.watchDisconnect()
+	defer stopWatching()
+
+	for {
+		// a client which went away must not pop an element nobody would receive
+		select {
+		case <-disconnected:
+			c.close()
+			return noReply, nil
+		default:
+		}
+		reply, err := tryPop()
+		if err != nil || reply != nil {
+			return reply, err
+		}
+		select {
+		case <-waiter.ready:
+		case <-expired:
+			return timeoutReply, nil
+		case <-disconnected:
+			c.close()
+			return noReply, nil
+		case <-aborted:
+			return timeoutReply, nil
+		}
+	}
+}
+
+// blockingListPop implements BLPOP and BRPOP
+func blockingListPop(c *client, args [][]byte, direction Direction) (interface{}, error) {
+	keys := args[1 : len(args)-1]
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var size int64
+	reply, err := blockingPop(c, keys, timeout, respNullArray{}, func(txn *badger.Txn) (interface{}, error) {
+		for _, key = range keys {
+			value, found, err := listPop(txn, key, direction)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				size, err = listLength(txn, key)
+				return []interface{}{key, value}, err
+			}
+		}
+		return nil, nil
+	})
+	if _, ok := reply.([]interface{}); !ok || err != nil {
+		return reply, err
+	}
+
+	event := "lpop"
+	if direction == DirectionRight {
+		event = "rpop"
+	}
+	notifyKeyspaceEvent(c, notifyList, event, key)
+	if size == 0 {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+	}
+	return reply, nil
+}
+
+func blpop(c *client, args [][]byte) (interface{}, error) {
+	return blockingListPop(c, args, DirectionLeft)
+}
+
+func brpop(c *client, args [][]byte) (interface{}, error) {
+	return blockingListPop(c, args, DirectionRight)
+}
+
+func blmpop(c *client, args [][]byte) (interface{}, error) {
+	timeout, err := parseTimeout(args[1])
+	if err != nil {
+		return nil, err
+	}
+	keys, direction, count, err := parseMultiPop(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	return multiPop(c, keys, direction, count, true, timeout)
+}
+
+func brpoplpush(c *client, args [][]byte) (interface{}, error) {
+	timeout, err := parseTimeout(args[3])
+	if err != nil {
+		return nil, err
+	}
+	return moveElement(c, args[1], args[2], DirectionRight, DirectionLeft, true, timeout)
+}
+
+func blmove(c *client, args [][]byte) (interface{}, error) {
+	from, err := parseDirection(args[3])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseDirection(args[4])
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(args[5])
+	if err != nil {
+		return nil, err
+	}
+	return moveElement(c, args[1], args[2], from, to, true, timeout)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until count clients are blocked
+func waitBlocked(t *testing.T, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for blocking.blockedCount() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d blocked clients, Actual %d", count, blocking.blockedCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectReply(t *testing.T, title string, reader *bufio.Reader, expected string) {
+	reply := make([]byte, len(expected))
+	_, err := io.ReadFull(reader, reply)
+	if err != nil || string(reply) != expected {
+		t.Fatalf("Case \"%s\":\n Expected reply=%q\n Actual reply=%q, err=%v", title, expected, reply, err)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer()
+	defer s.Shutdown(time.Second)
+	err = s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+
+	pusher, pusherReader := dialTestClient(t, addr)
+	defer pusher.Close()
+	first, firstReader := dialTestClient(t, addr)
+	defer first.Close()
+	second, secondReader := dialTestClient(t, addr)
+	defer second.Close()
+
+	// waiters are served in the order they blocked, whichever key they wait on
+	first.Write([]byte("BLPOP jobs 0\r\n"))
+	waitBlocked(t, 1)
+	second.Write([]byte("BLPOP other jobs 0\r\nPING\r\n"))
+	waitBlocked(t, 2)
+	pusher.Write([]byte("RPUSH jobs a b c\r\n"))
+	expectReply(t, "push", pusherReader, ":3\r\n")
+	expectReply(t, "first waiter", firstReader, "*2\r\n$4\r\njobs\r\n$1\r\na\r\n")
+	expectReply(t, "second waiter", secondReader, "*2\r\n$4\r\njobs\r\n$1\r\nb\r\n+PONG\r\n")
+	waitBlocked(t, 0)
+
+	testCases := []struct {
+		title   string
+		conn    net.Conn
+		reader  *bufio.Reader
+		command string
+		reply   string
+	}{
+		{"element available", first, firstReader, "BRPOP other jobs 0", "*2\r\n$4\r\njobs\r\n$1\r\nc\r\n"},
+		{"timeout", first, firstReader, "BLPOP jobs 0.05", "*-1\r\n"},
+		{"negative timeout", first, firstReader, "BLPOP jobs -1", "-ERR timeout is negative\r\n"},
+		{"invalid timeout", first, firstReader, "BLPOP jobs soon", "-ERR timeout is not a float or out of range\r\n"},
+		{"wrong type", first, firstReader, "SET name value\r\nBLPOP name 0", "+OK\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{"move timeout", first, firstReader, "BRPOPLPUSH jobs processing 0.05", "$-1\r\n"},
+		{"lmove timeout", first, firstReader, "BLMOVE jobs processing LEFT RIGHT 0.05", "$-1\r\n"},
+		{"invalid direction", first, firstReader, "BLMOVE jobs processing UP RIGHT 0", "-ERR syntax error\r\n"},
+		{"multi pop timeout", first, firstReader, "BLMPOP 0.05 2 jobs other LEFT", "*-1\r\n"},
+		{"multi pop invalid numkeys", first, firstReader, "BLMPOP 0 0 jobs LEFT", "-ERR numkeys should be greater than 0\r\n"},
+		{"empty element", first, firstReader, "*4\r\n$5\r\nRPUSH\r\n$6\r\nblanks\r\n$0\r\n\r\n$0\r\n\r\nBLPOP blanks 0.05\r\nBRPOP blanks 0.05\r\nLLEN blanks", ":2\r\n*2\r\n$6\r\nblanks\r\n$0\r\n\r\n*2\r\n$6\r\nblanks\r\n$0\r\n\r\n:0\r\n"},
+		{"empty element moved", first, firstReader, "*4\r\n$5\r\nRPUSH\r\n$6\r\nblanks\r\n$0\r\n\r\n$0\r\n\r\nRPOPLPUSH blanks moved\r\nBRPOPLPUSH blanks moved 0.05\r\nLLEN blanks\r\nLLEN moved\r\nLINDEX moved 0\r\nLINDEX moved -1\r\nLINDEX moved 2", ":2\r\n$0\r\n\r\n$0\r\n\r\n:0\r\n:2\r\n$0\r\n\r\n$0\r\n\r\n$-1\r\n"},
+		{"no wait in a transaction", first, firstReader, "MULTI\r\nBLPOP jobs 0\r\nEXEC", "+OK\r\n+QUEUED\r\n*1\r\n*-1\r\n"},
+	}
+	for _, testCase := range testCases {
+		testCase.conn.Write([]byte(testCase.command + "\r\n"))
+		expectReply(t, testCase.title, testCase.reader, testCase.reply)
+	}
+
+	// BRPOPLPUSH waits for the source and moves the element in one go
+	first.Write([]byte("BRPOPLPUSH jobs processing 0\r\n"))
+	waitBlocked(t, 1)
+	pusher.Write([]byte("LPUSH jobs d\r\n"))
+	expectReply(t, "push", pusherReader, ":1\r\n")
+	expectReply(t, "move", firstReader, "$1\r\nd\r\n")
+	pusher.Write([]byte("LLEN jobs\r\nLRANGE processing 0 -1\r\n"))
+	expectReply(t, "moved", pusherReader, ":0\r\n*1\r\n$1\r\nd\r\n")
+
+	// BLMPOP pops a batch from the first list written to
+	first.Write([]byte("BLMPOP 0 2 jobs other RIGHT COUNT 2\r\n"))
+	waitBlocked(t, 1)
+	pusher.Write([]byte("RPUSH other e f g\r\n"))
+	expectReply(t, "push", pusherReader, ":3\r\n")
+	expectReply(t, "multi pop", firstReader, "*2\r\n$5\r\nother\r\n*2\r\n$1\r\ng\r\n$1\r\nf\r\n")
+
+	// a waiter which disconnects stops waiting
+	second.Write([]byte("BLPOP jobs 0\r\n"))
+	waitBlocked(t, 1)
+	second.Close()
+	waitBlocked(t, 0)
+
+	// so does one which pipelined more commands, the element pushed next stays in the
+	// list
+	third, _ := dialTestClient(t, addr)
+	third.Write([]byte("BLPOP jobs 0\r\nPING\r\n"))
+	waitBlocked(t, 1)
+	third.Close()
+	waitBlocked(t, 0)
+	pusher.Write([]byte("RPUSH jobs h\r\nLRANGE jobs 0 -1\r\n"))
+	expectReply(t, "push after pipelined disconnect", pusherReader, ":1\r\n*1\r\n$1\r\nh\r\n")
+}
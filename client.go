@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	badger "github.com/dgraph-io/badger/v2"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ioBufferSize is the size of the per connection read and write buffers
+const ioBufferSize = 16 * 1024
+
+// streamBatchSize is how many bytes of a streamed reply are read before they are sent,
+// and streamWriteTimeout how long sending them can take
+const (
+	streamBatchSize    = 64 * 1024
+	streamWriteTimeout = 10 * time.Second
+)
+
+// maxBlockedInput is how much input a client waiting in a blocking command can send
+// before it is disconnected, the input is held until the command returns
+const maxBlockedInput = 1024 * 1024
+
+// lastClientID is the ID given to the last accepted connection
+var lastClientID int64
+
+var ErrNoSuchClient = errors.New("ERR No such client")
+
+// client is the server side state of a single connection
+type client struct {
+	id     int64
+	conn   net.Conn
+	reader *requestReader
+	// outMu guards writer, replyBuf and proto, replies are written by the client
+	// goroutine while pub/sub messages are written by pushLoop
+	outMu sync.Mutex
+	// writer buffers replies until every pipelined command read so far has been
+	// executed, so a pipeline costs one write instead of one per command
+	writer *bufio.Writer
+	// replyBuf is reused to encode replies
+	replyBuf []byte
+	// proto is the RESP version replies are encoded with, 2 until the client sends HELLO 3
+	proto int
+
+	// pushMu guards the pub/sub messages waiting for pushLoop to write them
+	pushMu  sync.Mutex
+	pending []respPush
+	// pendingSize is roughly how many bytes the pending messages take
+	pendingSize int64
+	// overSoftLimitSince is when pendingSize went over the soft output buffer limit
+	overSoftLimitSince time.Time
+	// pushClosed is set once the client went over the output buffer limit or
+	// disconnected, messages are dropped from then on
+	pushClosed bool
+	// pushed wakes pushLoop up, pushDone stops it. Both are nil until the first
+	// subscription.
+	pushed   chan struct{}
+	pushDone chan struct{}
+	// outputLimit applies to the pending messages of subscribed clients
+	outputLimit OutputBufferLimit
+	// maxReplySize bounds the size of LRANGE replies, 0 disables it
+	maxReplySize int64
+
+	// subscriptions and patterns are the channels and patterns the client subscribed
+	// to, they are guarded by the pubsub registry lock and only changed by the client
+	// goroutine
+	subscriptions map[string]bool
+	patterns      map[string]bool
+
+	// multi holds the commands queued since MULTI, nil outside of a MULTI block
+	multi *multiState
+	// watched are the keys the client watches, see watchRegistry
+	watched []watchedKey
+	// txn is the transaction of the EXEC being executed, commands run in it instead of
+	// their own transaction
+	txn *badger.Txn
+	// keyspaceEvents are the events of the commands run by EXEC so far, published
+	// once its transaction is committed
+	keyspaceEvents []keyspaceEvent
+	// writtenKeys are the keys written by the commands run by EXEC so far, the clients
+	// blocked on them are woken up once its transaction is committed
+	writtenKeys [][]byte
+	// blockedInput is the input received by watchDisconnect while a blocking command
+	// waits, it is read before the connection
+	blockedInput []byte
+
+	// idleTimeout closes the connection when nothing is received for that long, 0
+	// disables it
+	idleTimeout time.Duration
+
+	createdAt time.Time
+	// db is the selected database, only database 0 exists for now
+	db int
+
+	// mu guards the fields below, they are read by other clients with CLIENT LIST and
+	// CLIENT KILL
+	mu   sync.Mutex
+	name string
+	// lastCommand is the name of the last command the client sent, NULL before the first
+	lastCommand string
+	// lastInteraction is when the client last started or finished a command
+	lastInteraction time.Time
+	// user is the ACL user the connection is authenticated as, nil until it sends AUTH
+	// when the default user requires a password
+	user *aclUser
+	// busy is set while a command is being executed and its reply written
+	busy bool
+	// closing is set once the server starts shutting down or the client is killed
+	closing bool
+	// blocked is set while the client waits in a blocking command, it is closed when
+	// the client is closed so the command stops waiting
+	blocked chan struct{}
+}
+
+func newClient(conn net.Conn) *client {
+	c := &client{
+		id:     atomic.AddInt64(&lastClientID, 1),
+		conn:   conn,
+		writer: bufio.NewWriterSize(conn, ioBufferSize),
+		proto:  2,
+		user:   acl.initialUser(),
+
+		subscriptions: map[string]bool{},
+		patterns:      map[string]bool{},
+
+		createdAt:       time.Now(),
+		lastCommand:     "NULL",
+		lastInteraction: time.Now(),
+	}
+	c.reader = newRequestReader(flushingReader{c})
+	c.reader.unauthenticated = func() bool { return c.currentUser() == nil }
+	return c
+}
+
+// flushingReader sends the buffered replies before waiting for more input, so a client
+// which sent only part of a command still gets the replies of the previous ones. It
+// also enforces the idle timeout.
+type flushingReader struct {
+	c *client
+}
+
+func (r flushingReader) Read(p []byte) (int, error) {
+	err := r.c.flush()
+	if err != nil {
+		return 0, err
+	}
+	if len(r.c.blockedInput) > 0 {
+		n := copy(p, r.c.blockedInput)
+		r.c.blockedInput = r.c.blockedInput[n:]
+		if len(r.c.blockedInput) == 0 {
+			r.c.blockedInput = nil
+		}
+		return n, nil
+	}
+	// subscribers only wait for messages, they are never idle
+	if r.c.idleTimeout > 0 && !r.c.isSubscribed() {
+		r.c.conn.SetReadDeadline(time.Now().Add(r.c.idleTimeout))
+	} else if r.c.idleTimeout > 0 {
+		r.c.conn.SetReadDeadline(time.Time{})
+	}
+	return r.c.conn.Read(p)
+}
+
+// beginCommand marks the client as busy running the named command, it returns false if
+// the client is closing and the command must not be executed
+func (c *client) beginCommand(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return false
+	}
+	c.busy = true
+	c.lastCommand = name
+	c.lastInteraction = time.Now()
+	return true
+}
+
+// endCommand marks the client as idle, it returns false if the client started closing
+// while the command was running
+func (c *client) endCommand() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = false
+	c.lastInteraction = time.Now()
+	return !c.closing
+}
+
+func (c *client) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func (c *client) currentUser() *aclUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+func (c *client) setUser(u *aclUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = u
+}
+
+// close asks the client to stop, an idle client is disconnected right away while a busy
+// one finishes its command and replies first
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+	if c.blocked != nil {
+		close(c.blocked)
+		c.blocked = nil
+	}
+	if !c.busy {
+		c.conn.Close()
+	}
+}
+
+// beginBlocking marks the client as waiting in a blocking command, the returned channel
+// is closed if the client is closed in the meantime
+func (c *client) beginBlocking() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocked := make(chan struct{})
+	if c.closing {
+		close(blocked)
+		return blocked
+	}
+	c.blocked = blocked
+	return blocked
+}
+
+func (c *client) endBlocking() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocked = nil
+}
+
+// watchDisconnect reads from the connection while a blocking command waits, the
+// returned channel is closed if the client disconnects. Reading goes on after input
+// arrives so a client which pipelined more commands is still seen going away, the input
+// is kept in blockedInput for the next commands. A client sending more than
+// maxBlockedInput is treated as disconnected. stop must be called before reading
+// commands again.
+func (c *client) watchDisconnect() (<-chan struct{}, func()) {
+	if c.conn == nil {
+		return nil, func() {}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	disconnected := make(chan struct{})
+	done := make(chan struct{})
+	var stopping int32
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.conn.Read(buf)
+			c.blockedInput = append(c.blockedInput, buf[:n]...)
+			if err == nil && len(c.blockedInput) <= maxBlockedInput {
+				continue
+			}
+			if err == nil {
+				logger.Warn("Closing blocked client over the input limit",
+					zap.String("addr", c.addr()),
+					zap.Int("input", len(c.blockedInput)),
+				)
+				c.blockedInput = nil
+			}
+			if atomic.LoadInt32(&stopping) == 0 {
+				close(disconnected)
+			}
+			return
+		}
+	}()
+
+	stop := func() {
+		atomic.StoreInt32(&stopping, 1)
+		// an expired deadline interrupts the read
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	return disconnected, stop
+}
+
+// addr is the address of the client, unix socket clients are shown as socket path:0
+// the same way redis does
+func (c *client) addr() string {
+	return connAddr(c.conn.RemoteAddr(), c.conn.LocalAddr())
+}
+
+// localAddr is the address the client connected to
+func (c *client) localAddr() string {
+	local := c.conn.LocalAddr()
+	if unixAddr, ok := local.(*net.UnixAddr); ok {
+		return unixAddr.Name + ":0"
+	}
+	return local.String()
+}
+
+func connAddr(remote, local net.Addr) string {
+	if unixAddr, ok := local.(*net.UnixAddr); ok {
+		return unixAddr.Name + ":0"
+	}
+	if remote == nil {
+		return ""
+	}
+	return remote.String()
+}
+
+func (c *client) setName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+
+// info describes the client with the same fields as redis CLIENT LIST
+func (c *client) info() string {
+	subscriptions, patterns := pubsub.subscriptionCounts(c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	user := "default"
+	if c.user != nil {
+		user = acl.username(c.user)
+	}
+	flags := "N"
+	if c.blocked != nil {
+		flags = "b"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d cmd=%s user=%s",
+		c.id,
+		c.addr(),
+		c.localAddr(),
+		c.name,
+		int64(now.Sub(c.createdAt)/time.Second),
+		int64(now.Sub(c.lastInteraction)/time.Second),
+		flags,
+		c.db,
+		subscriptions,
+		patterns,
+		c.lastCommand,
+		user,
+	)
+}
+
+// replyProtocolError tells the client its input could not be understood, the
+// connection is closed afterwards as the rest of its input cannot be trusted
+func (c *client) replyProtocolError(err error) {
+	logger.Info("Protocol error from client",
+		zap.String("addr", c.addr()),
+		zap.Error(err),
+	)
+	c.writeReply(errors.New("ERR " + err.Error()))
+	c.flush()
+}
+
+// writeReply encodes reply with the protocol version of the connection and adds it to
+// the output buffer, it is sent once the buffer is full or flushReplies is called
+func (c *client) writeReply(reply interface{}) error {
+	if reply == noReply {
+		return nil
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return c.bufferReply(reply)
+}
+
+// bufferReply is writeReply for callers which hold outMu
+func (c *client) bufferReply(reply interface{}) error {
+	buf, err := appendReply(c.replyBuf[:0], reply, c.proto)
+	if err != nil {
+		logger.Error("Cannot encode reply", zap.Error(err), zap.Any("reply", reply))
+		buf, _ = appendReply(c.replyBuf[:0], ErrInternal, c.proto)
+	}
+	if cap(buf) <= ioBufferSize {
+		// keep the buffer unless a large reply made it grow
+		c.replyBuf = buf
+	}
+	_, err = c.writer.Write(buf)
+	return err
+}
+
+// streamArray writes an array reply of count bulk strings, elements calls write with
+// each of them as it reads them. They are sent in batches of streamBatchSize bytes so a
+// large reply is never held in memory, and a client which takes more than
+// streamWriteTimeout to receive a batch is closed rather than keeping the command and
+// its transaction waiting. An error found before the first batch is sent is returned so
+// the command can reply with it, the client is closed if the reply already started.
+func (c *client) streamArray(count int64, elements func(write func(element []byte) error) error) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	var batch []byte
+	written := int64(0)
+	started := false
+	send := func() error {
+		if !started {
+			_, err := c.writer.Write(appendLength(c.replyBuf[:0], '*', int(count)))
+			if err != nil {
+				return err
+			}
+			started = true
+		}
+		_, err := c.writer.Write(batch)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		err = c.writer.Flush()
+		c.conn.SetWriteDeadline(time.Time{})
+		return err
+	}
+
+	var writeErr error
+	err := elements(func(element []byte) error {
+		batch = appendBulk(batch, element)
+		written++
+		if len(batch) >= streamBatchSize {
+			writeErr = send()
+		}
+		return writeErr
+	})
+	if err == nil && written != count {
+		err = ErrInvalidListMetadata
+	}
+	if writeErr != nil {
+		logger.Debug("Cannot write to connection", zap.Error(writeErr))
+		c.close()
+		return nil
+	}
+	if err != nil && !started {
+		return err
+	}
+	if err != nil {
+		logger.Error("Cannot stream reply", zap.String("addr", c.addr()), zap.Int64("expected", count), zap.Int64("written", written), zap.Error(err))
+		c.close()
+		return nil
+	}
+
+	// the last batch is sent with the replies of the next commands
+	if !started {
+		_, err = c.writer.Write(appendLength(c.replyBuf[:0], '*', int(count)))
+	}
+	if err == nil {
+		_, err = c.writer.Write(batch)
+	}
+	if err != nil {
+		logger.Debug("Cannot write to connection", zap.Error(err))
+		c.close()
+	}
+	return nil
+}
+
+// flushReplies sends the buffered replies once every command the client pipelined
+// has been executed
+func (c *client) flushReplies() error {
+	if c.reader.Buffered() > 0 {
+		return nil
+	}
+	return c.flush()
+}
+
+func (c *client) flush() error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.writer.Buffered() == 0 {
+		return nil
+	}
+	return c.writer.Flush()
+}
+
+func (c *client) setProto(proto int) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	c.proto = proto
+}
+
+// isValidClientName tells whether name can be used with HELLO SETNAME, names are shown
+// in space separated lists so only printable characters besides space are allowed
+func isValidClientName(name []byte) bool {
+	for _, char := range name {
+		if char < '!' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientCommand implements the CLIENT subcommands which inspect and manage connections
+func clientCommand(c *client, args [][]byte) (interface{}, error) {
+	subcommand := strings.ToUpper(string(args[1]))
+	switch {
+	case subcommand == "ID" && len(args) == 2:
+		return c.id, nil
+	case subcommand == "INFO" && len(args) == 2:
+		return respVerbatim{"txt", []byte(c.info() + "\n")}, nil
+	case subcommand == "LIST":
+		return clientList(args[2:])
+	case subcommand == "SETNAME" && len(args) == 3:
+		if !isValidClientName(args[2]) {
+			return nil, ErrInvalidClientName
+		}
+		c.setName(string(args[2]))
+		return "OK", nil
+	case subcommand == "GETNAME" && len(args) == 2:
+		if c.name == "" {
+			return nil, nil
+		}
+		return []byte(c.name), nil
+	case subcommand == "KILL" && len(args) >= 3:
+		return clientKill(c, args[2:])
+	}
+	return nil, fmt.Errorf("ERR Unknown subcommand or wrong number of arguments for '%s'", args[1])
+}
+
+// clientList describes every client, or the ones with the given ids when called as
+// CLIENT LIST ID id [id ...]
+func clientList(args [][]byte) (interface{}, error) {
+	var ids map[int64]bool
+	if len(args) > 0 {
+		if len(args) < 2 || strings.ToUpper(string(args[0])) != "ID" {
+			return nil, ErrSyntax
+		}
+		ids = map[int64]bool{}
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil || id <= 0 {
+				return nil, errors.New("ERR Invalid client ID")
+			}
+			ids[id] = true
+		}
+	}
+
+	var list strings.Builder
+	for _, other := range srv.clientList() {
+		if ids == nil || ids[other.id] {
+			list.WriteString(other.info())
+			list.WriteByte('\n')
+		}
+	}
+	return respVerbatim{"txt", []byte(list.String())}, nil
+}
+
+// clientKill closes clients, either with the old CLIENT KILL addr form or by filters:
+//
+//	ID client-id, ADDR ip:port, LADDR ip:port, USER username
+//	SKIPME yes|no  whether the calling client is spared, yes by default
+//
+// The old form replies OK or an error, filters reply with the number of closed clients.
+func clientKill(c *client, args [][]byte) (interface{}, error) {
+	if len(args) == 1 {
+		addr := string(args[0])
+		if srv.closeClients(func(other *client) bool { return other.addr() == addr }) == 0 {
+			return nil, ErrNoSuchClient
+		}
+		return "OK", nil
+	}
+	if len(args)%2 != 0 {
+		return nil, ErrSyntax
+	}
+
+	filters := []func(other *client) bool{}
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "ID":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, errors.New("ERR client-id should be greater than 0")
+			}
+			filters = append(filters, func(other *client) bool { return other.id == id })
+		case "ADDR":
+			filters = append(filters, func(other *client) bool { return other.addr() == value })
+		case "LADDR":
+			filters = append(filters, func(other *client) bool { return other.localAddr() == value })
+		case "USER":
+			if _, ok := acl.getUser(value); !ok {
+				return nil, fmt.Errorf("ERR No such user '%s'", value)
+			}
+			filters = append(filters, func(other *client) bool {
+				user := other.currentUser()
+				return user != nil && acl.username(user) == value
+			})
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return nil, ErrSyntax
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return srv.closeClients(func(other *client) bool {
+		if skipMe && other == c {
+			return false
+		}
+		for _, filter := range filters {
+			if !filter(other) {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
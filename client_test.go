@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readTestReply reads a single reply which is not an array
+func readTestReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil || line[0] != '$' || line == "$-1\r\n" {
+		return line, err
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return line, err
+	}
+	bulk := make([]byte, size+2)
+	_, err = io.ReadFull(reader, bulk)
+	return line + string(bulk), err
+}
+
+func TestClientCommand(t *testing.T) {
+	defer func(previous *server) { srv = previous }(srv)
+	srv = newServer()
+	defer srv.Shutdown(time.Second)
+	err := srv.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.listeners[0].Addr().String()
+
+	conns := make([]net.Conn, 5)
+	readers := make([]*bufio.Reader, 5)
+	ids := make([]int64, 5)
+	for i := range conns {
+		conns[i], readers[i] = dialTestClient(t, addr)
+		defer conns[i].Close()
+		conns[i].Write([]byte("CLIENT ID\r\n"))
+		reply, err := readers[i].ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i], err = strconv.ParseInt(strings.TrimSpace(reply[1:]), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	caller, reader := conns[0], readers[0]
+
+	testCases := []struct {
+		title   string
+		command string
+		reply   string
+		// killed is the connection the command is expected to close, -1 for none
+		killed int
+	}{
+		{"id", "CLIENT ID", fmt.Sprintf(":%d\r\n", ids[0]), -1},
+		{"no name", "CLIENT GETNAME", "$-1\r\n", -1},
+		{"set name", "CLIENT SETNAME worker-1", "+OK\r\n", -1},
+		{"get name", "CLIENT GETNAME", "$8\r\nworker-1\r\n", -1},
+		{"name with a space", "CLIENT SETNAME \"bad name\"", "-ERR Client names cannot contain spaces", -1},
+		{"name with a newline", "CLIENT SETNAME \"bad\\nname\"", "-ERR Client names cannot contain spaces", -1},
+		{"list by id", fmt.Sprintf("CLIENT LIST ID %d", ids[0]), fmt.Sprintf("id=%d addr=%s laddr=%s name=worker-1 ", ids[0], caller.LocalAddr(), addr), -1},
+		{"list every client", "CLIENT LIST", fmt.Sprintf("id=%d addr=%s ", ids[4], conns[4].LocalAddr()), -1},
+		{"list invalid id", "CLIENT LIST ID x", "-ERR Invalid client ID\r\n", -1},
+		{"clients info", "INFO clients", "connected_clients:5\r\n", -1},
+		{"kill by id", fmt.Sprintf("CLIENT KILL ID %d", ids[1]), ":1\r\n", 1},
+		{"kill by addr", fmt.Sprintf("CLIENT KILL ADDR %s", conns[2].LocalAddr()), ":1\r\n", 2},
+		{"old kill form", fmt.Sprintf("CLIENT KILL %s", conns[3].LocalAddr()), "+OK\r\n", 3},
+		{"old kill form without a client", "CLIENT KILL 192.0.2.1:1", "-ERR No such client\r\n", -1},
+		{"kill by user skips the caller", "CLIENT KILL USER default", ":1\r\n", 4},
+		{"kill unknown user", "CLIENT KILL USER nobody", "-ERR No such user 'nobody'\r\n", -1},
+		{"kill invalid id", "CLIENT KILL ID 0", "-ERR client-id should be greater than 0\r\n", -1},
+		{"kill without a value", "CLIENT KILL ID 1 SKIPME", "-ERR syntax error\r\n", -1},
+		{"unknown subcommand", "CLIENT FOO", "-ERR Unknown subcommand or wrong number of arguments for 'FOO'\r\n", -1},
+		{"kill itself", fmt.Sprintf("CLIENT KILL ID %d SKIPME no", ids[0]), ":1\r\n", 0},
+	}
+	for _, testCase := range testCases {
+		caller.Write([]byte(testCase.command + "\r\n"))
+		reply, err := readTestReply(reader)
+		if err != nil || !strings.Contains(reply, testCase.reply) {
+			t.Fatalf("Case \"%s\":\n Expected reply containing %q\n Actual reply=%q, err=%v", testCase.title, testCase.reply, reply, err)
+		}
+		if testCase.killed >= 0 {
+			_, err = readers[testCase.killed].ReadByte()
+			if err == nil {
+				t.Fatalf("Case \"%s\":\n Expected connection %d to be closed", testCase.title, testCase.killed)
+			}
+		}
+	}
+}
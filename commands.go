@@ -17,6 +17,11 @@ const (
 	CommandFlagAsking        CommandFlag = "asking"
 	CommandFlagFast          CommandFlag = "fast"
 	CommandFlagMovableKeys   CommandFlag = "movablekeys"
+	// CommandFlagNoAuth commands can be run before authenticating and are not
+	// restricted by ACL rules
+	CommandFlagNoAuth CommandFlag = "no_auth"
+	// CommandFlagNoMulti commands cannot be queued in a MULTI block
+	CommandFlagNoMulti CommandFlag = "no_multi"
 )
 
 type command struct {
@@ -27,6 +32,9 @@ type command struct {
 	lastKeyPos  int8
 	stepCount   int8
 	handler     commandHandler
+	// getKeys finds the keys of commands with the movablekeys flag, whose keys cannot be
+	// described with firstKeyPos, lastKeyPos and stepCount
+	getKeys func(args [][]byte) [][]byte
 }
 
 func (c command) Slice() []interface{} {
@@ -44,6 +52,65 @@ func (c command) Slice() []interface{} {
 	}
 }
 
+// checkArity tells whether argc arguments, including the command name, are valid.
+// A positive arity is the exact number of arguments and a negative one is the minimum.
+func (c command) checkArity(argc int) bool {
+	if c.arity < 0 {
+		return argc >= -int(c.arity)
+	}
+	return argc == int(c.arity)
+}
+
+func (c command) hasFlag(flag CommandFlag) bool {
+	for _, f := range c.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// keyArgs returns the arguments of a call which are keys, as described by firstKeyPos,
+// lastKeyPos and stepCount, or found by getKeys. A negative lastKeyPos counts from the
+// end, -1 being the last argument.
+func (c command) keyArgs(args [][]byte) [][]byte {
+	if c.getKeys != nil {
+		return c.getKeys(args)
+	}
+	if c.firstKeyPos <= 0 || c.stepCount <= 0 {
+		return nil
+	}
+	last := int(c.lastKeyPos)
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+
+	keys := [][]byte{}
+	for i := int(c.firstKeyPos); i <= last; i += int(c.stepCount) {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// Map describes the command the same way Slice does, with named fields for RESP3 clients
+func (c command) Map() respMap {
+	flags := respSet{}
+	for _, flag := range c.flags {
+		flags = append(flags, string(flag))
+	}
+	return respMap{
+		{"name", []byte(c.name)},
+		{"arity", c.arity},
+		{"flags", flags},
+		{"first_key", c.firstKeyPos},
+		{"last_key", c.lastKeyPos},
+		{"step", c.stepCount},
+	}
+}
+
 var commandMap = map[string]command{
 	"PING": command{
 		name:  "ping",
@@ -57,9 +124,83 @@ var commandMap = map[string]command{
 		stepCount:   0,
 		handler:     ping,
 	},
+	"HELLO": command{
+		name:  "hello",
+		arity: -1,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+			CommandFlagNoAuth,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     hello,
+	},
+	"AUTH": command{
+		name:  "auth",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagSkipMonitor,
+			CommandFlagFast,
+			CommandFlagNoAuth,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     auth,
+	},
+	"QUIT": command{
+		name:  "quit",
+		arity: -1,
+		flags: []CommandFlag{
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+			CommandFlagNoAuth,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     quit,
+	},
+	"ACL": command{
+		name:  "acl",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagAdmin,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagSkipMonitor,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+	},
+	"CLIENT": command{
+		name:  "client",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagAdmin,
+			CommandFlagNoscript,
+			CommandFlagRandom,
+			CommandFlagLoading,
+			CommandFlagStale,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     clientCommand,
+	},
 	"COMMAND": command{
 		name:  "command",
-		arity: 0,
+		arity: -1,
 		flags: []CommandFlag{
 			CommandFlagRandom,
 			CommandFlagLoading,
@@ -82,6 +223,20 @@ var commandMap = map[string]command{
 		stepCount:   0,
 		handler:     info,
 	},
+	"SHUTDOWN": command{
+		name:  "shutdown",
+		arity: -1,
+		flags: []CommandFlag{
+			CommandFlagAdmin,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     shutdown,
+	},
 	"GET": command{
 		name:  "get",
 		arity: 2,
@@ -130,6 +285,18 @@ var commandMap = map[string]command{
 		stepCount:   0,
 		handler:     keys,
 	},
+	"OBJECT": command{
+		name:  "object",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagReadonly,
+			CommandFlagRandom,
+		},
+		firstKeyPos: 2,
+		lastKeyPos:  2,
+		stepCount:   1,
+		handler:     object,
+	},
 	"LPUSH": command{
 		name:  "lpush",
 		arity: -3,
@@ -156,9 +323,119 @@ var commandMap = map[string]command{
 		stepCount:   1,
 		handler:     rpush,
 	},
+	"LPUSHX": command{
+		name:  "lpushx",
+		arity: -3,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+			CommandFlagFast,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     lpushx,
+	},
+	"RPUSHX": command{
+		name:  "rpushx",
+		arity: -3,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+			CommandFlagFast,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     rpushx,
+	},
+	"LINSERT": command{
+		name:  "linsert",
+		arity: 5,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     linsert,
+	},
+	"LREM": command{
+		name:  "lrem",
+		arity: 4,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     lrem,
+	},
+	"LTRIM": command{
+		name:  "ltrim",
+		arity: 4,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     ltrim,
+	},
+	"RPOPLPUSH": command{
+		name:  "rpoplpush",
+		arity: 3,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  2,
+		stepCount:   1,
+		handler:     rpoplpush,
+	},
+	"LMOVE": command{
+		name:  "lmove",
+		arity: 5,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  2,
+		stepCount:   1,
+		handler:     lmove,
+	},
+	"LPOS": command{
+		name:  "lpos",
+		arity: -3,
+		flags: []CommandFlag{
+			CommandFlagReadonly,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  1,
+		stepCount:   1,
+		handler:     lpos,
+	},
+	"LMPOP": command{
+		name:  "lmpop",
+		arity: -4,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagMovableKeys,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     lmpop,
+		getKeys: func(args [][]byte) [][]byte {
+			return numKeysArgs(args, 1)
+		},
+	},
 	"LPOP": command{
 		name:  "lpop",
-		arity: 2,
+		arity: -2,
 		flags: []CommandFlag{
 			CommandFlagWrite,
 			CommandFlagFast,
@@ -170,7 +447,7 @@ var commandMap = map[string]command{
 	},
 	"RPOP": command{
 		name:  "rpop",
-		arity: 2,
+		arity: -2,
 		flags: []CommandFlag{
 			CommandFlagWrite,
 			CommandFlagFast,
@@ -228,4 +505,228 @@ var commandMap = map[string]command{
 		stepCount:   1,
 		handler:     llen,
 	},
+	"BLPOP": command{
+		name:  "blpop",
+		arity: -3,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagNoscript,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  -2,
+		stepCount:   1,
+		handler:     blpop,
+	},
+	"BRPOP": command{
+		name:  "brpop",
+		arity: -3,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagNoscript,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  -2,
+		stepCount:   1,
+		handler:     brpop,
+	},
+	"BRPOPLPUSH": command{
+		name:  "brpoplpush",
+		arity: 4,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+			CommandFlagNoscript,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  2,
+		stepCount:   1,
+		handler:     brpoplpush,
+	},
+	"BLMOVE": command{
+		name:  "blmove",
+		arity: 6,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagDenyOOM,
+			CommandFlagNoscript,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  2,
+		stepCount:   1,
+		handler:     blmove,
+	},
+	"BLMPOP": command{
+		name:  "blmpop",
+		arity: -5,
+		flags: []CommandFlag{
+			CommandFlagWrite,
+			CommandFlagMovableKeys,
+			CommandFlagNoscript,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     blmpop,
+		getKeys: func(args [][]byte) [][]byte {
+			return numKeysArgs(args, 2)
+		},
+	},
+	"MULTI": command{
+		name:  "multi",
+		arity: 1,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     multi,
+	},
+	"EXEC": command{
+		name:  "exec",
+		arity: 1,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagSkipMonitor,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     exec,
+	},
+	"DISCARD": command{
+		name:  "discard",
+		arity: 1,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     discard,
+	},
+	"WATCH": command{
+		name:  "watch",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+		},
+		firstKeyPos: 1,
+		lastKeyPos:  -1,
+		stepCount:   1,
+		handler:     watch,
+	},
+	"UNWATCH": command{
+		name:  "unwatch",
+		arity: 1,
+		flags: []CommandFlag{
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     unwatch,
+	},
+	"SUBSCRIBE": command{
+		name:  "subscribe",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagNoMulti,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     subscribe,
+	},
+	"UNSUBSCRIBE": command{
+		name:  "unsubscribe",
+		arity: -1,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagNoMulti,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     unsubscribe,
+	},
+	"PSUBSCRIBE": command{
+		name:  "psubscribe",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagNoMulti,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     psubscribe,
+	},
+	"PUNSUBSCRIBE": command{
+		name:  "punsubscribe",
+		arity: -1,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagNoscript,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagNoMulti,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     punsubscribe,
+	},
+	"PUBLISH": command{
+		name:  "publish",
+		arity: 3,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagLoading,
+			CommandFlagStale,
+			CommandFlagFast,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     publish,
+	},
+	"PUBSUB": command{
+		name:  "pubsub",
+		arity: -2,
+		flags: []CommandFlag{
+			CommandFlagPubSub,
+			CommandFlagRandom,
+			CommandFlagLoading,
+			CommandFlagStale,
+		},
+		firstKeyPos: 0,
+		lastKeyPos:  0,
+		stepCount:   0,
+		handler:     pubsubCommand,
+	},
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config holds everything that can be set from the command line or from the config file
+type Config struct {
+	Bind []string
+	// Port is the plaintext TCP port, 0 disables it
+	Port int
+	// TLSPort is the TLS port, 0 disables it
+	TLSPort int
+	TLS     TLSOptions
+	// UnixSocket is the path of a unix socket to listen on, empty disables it
+	UnixSocket     string
+	UnixSocketPerm os.FileMode
+	// ACLFile is where users are loaded from at startup and by ACL LOAD, and saved to by
+	// ACL SAVE
+	ACLFile string
+	// MaxClients is how many clients can be connected at once
+	MaxClients int
+	// Timeout closes clients idle for that many seconds, 0 disables it
+	Timeout int
+	// TCPKeepAlive is the period of TCP keepalive probes in seconds, 0 disables them
+	TCPKeepAlive int
+	// PubSubOutputLimit disconnects subscribers which do not read their messages fast
+	// enough
+	PubSubOutputLimit OutputBufferLimit
+	// NotifyKeyspaceEvents are the keyspace event classes published to subscribers,
+	// with the flag letters of redis
+	NotifyKeyspaceEvents int
+	// ListEncoding is the encoding of new lists, linkedlist or quicklist
+	ListEncoding string
+	// ListChunkSize bounds the chunks of quicklist encoded lists, in bytes
+	ListChunkSize int64
+	// MaxReplySize bounds the size of LRANGE replies, in bytes, 0 disables it
+	MaxReplySize int64
+	// ShutdownTimeout is how many seconds running commands get to finish on shutdown
+	ShutdownTimeout int
+	LogLevel        zapcore.Level
+	LogFormat       string
+	LogFile         string
+	Storage         StorageOptions
+}
+
+func defaultConfig() Config {
+	return Config{
+		Bind:            []string{"0.0.0.0"},
+		Port:            6379,
+		MaxClients:      10000,
+		TCPKeepAlive:    300,
+		ShutdownTimeout: 10,
+		ListEncoding:    listEncodingLinkedList,
+		ListChunkSize:   8 * 1024,
+		LogLevel:        zapcore.InfoLevel,
+		LogFormat:       "console",
+		PubSubOutputLimit: OutputBufferLimit{
+			Hard:        32 * 1024 * 1024,
+			Soft:        8 * 1024 * 1024,
+			SoftSeconds: 60,
+		},
+		TLS: TLSOptions{
+			AuthClients: "yes",
+		},
+		Storage: StorageOptions{
+			Dir: "./data",
+		},
+	}
+}
+
+// configDirective is a single setting, it is available both as a config file line
+// (`name arg [arg ...]`) and as a command line flag (`-name "arg [arg ...]"`)
+type configDirective struct {
+	usage  string
+	isBool bool
+	set    func(cfg *Config, args []string) error
+}
+
+var configDirectives = map[string]configDirective{
+	"bind": {
+		usage: "addresses to listen on, separated by spaces",
+		set: func(cfg *Config, args []string) error {
+			if len(args) == 0 {
+				return errors.New("wrong number of arguments")
+			}
+			cfg.Bind = args
+			return nil
+		},
+	},
+	"tls-port":         intDirective("TLS port to listen on, 0 disables TLS", func(cfg *Config) *int { return &cfg.TLSPort }),
+	"tls-cert-file":    stringDirective("server certificate in PEM format", func(cfg *Config) *string { return &cfg.TLS.CertFile }),
+	"tls-key-file":     stringDirective("private key of the server certificate in PEM format", func(cfg *Config) *string { return &cfg.TLS.KeyFile }),
+	"tls-ca-cert-file": stringDirective("CA certificates client certificates are verified with", func(cfg *Config) *string { return &cfg.TLS.CACertFile }),
+	"tls-auth-clients": enumDirective("require client certificates, yes, no or optional", func(cfg *Config) *string { return &cfg.TLS.AuthClients }, "yes", "no", "optional"),
+	"aclfile":          stringDirective("file with the ACL users", func(cfg *Config) *string { return &cfg.ACLFile }),
+	"unixsocket":       stringDirective("path of a unix socket to listen on", func(cfg *Config) *string { return &cfg.UnixSocket }),
+	"unixsocketperm": {
+		usage: "permissions of the unix socket in octal, like 700",
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			perm, err := strconv.ParseUint(args[0], 8, 32)
+			if err != nil || perm > 0777 {
+				return fmt.Errorf("invalid socket permissions '%s'", args[0])
+			}
+			cfg.UnixSocketPerm = os.FileMode(perm)
+			return nil
+		},
+	},
+	"client-output-buffer-limit": {
+		usage: "output buffer limit of a client class, class hard-limit soft-limit soft-seconds",
+		set:   setOutputBufferLimit,
+	},
+	"notify-keyspace-events": {
+		usage: "keyspace events to publish, like KEA, empty disables them",
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			classes, err := parseNotifyFlags(args[0])
+			if err != nil {
+				return err
+			}
+			cfg.NotifyKeyspaceEvents = classes
+			return nil
+		},
+	},
+	"list-encoding":              enumDirective("encoding of new lists, linkedlist or quicklist", func(cfg *Config) *string { return &cfg.ListEncoding }, listEncodingLinkedList, listEncodingQuicklist),
+	"max-reply-size":             sizeDirective("maximum size of an LRANGE reply, 0 disables it", func(cfg *Config) *int64 { return &cfg.MaxReplySize }),
+	"list-chunk-size":            boundedSizeDirective("maximum size of the chunks of quicklist encoded lists", 1, maxListChunkSize, func(cfg *Config) *int64 { return &cfg.ListChunkSize }),
+	"port":                       intDirective("TCP port to listen on, 0 disables plaintext connections", func(cfg *Config) *int { return &cfg.Port }),
+	"maxclients":                 minIntDirective("maximum number of connected clients", 1, func(cfg *Config) *int { return &cfg.MaxClients }),
+	"timeout":                    minIntDirective("close clients idle for that many seconds, 0 disables it", 0, func(cfg *Config) *int { return &cfg.Timeout }),
+	"tcp-keepalive":              minIntDirective("seconds between TCP keepalive probes, 0 disables them", 0, func(cfg *Config) *int { return &cfg.TCPKeepAlive }),
+	"shutdown-timeout":           minIntDirective("seconds to wait for running commands on shutdown", 0, func(cfg *Config) *int { return &cfg.ShutdownTimeout }),
+	"dir":                        stringDirective("directory to store the database in", func(cfg *Config) *string { return &cfg.Storage.Dir }),
+	"in-memory":                  boolDirective("keep the database in memory only, data is lost on exit", func(cfg *Config) *bool { return &cfg.Storage.InMemory }),
+	"sync-writes":                boolDirective("sync every write to disk before replying", func(cfg *Config) *bool { return &cfg.Storage.SyncWrites }),
+	"logfile":                    stringDirective("file to write the log to, empty means standard output", func(cfg *Config) *string { return &cfg.LogFile }),
+	"log-format":                 enumDirective("log encoding, console or json", func(cfg *Config) *string { return &cfg.LogFormat }, "console", "json"),
+	"loglevel":                   {usage: "log verbosity, debug, verbose, notice, warning or error", set: setLogLevel},
+	"badger-memtable-size":       sizeDirective("size of each badger memtable", func(cfg *Config) *int64 { return &cfg.Storage.MemTableSize }),
+	"badger-num-memtables":       intDirective("number of badger memtables kept in memory", func(cfg *Config) *int { return &cfg.Storage.NumMemtables }),
+	"badger-value-threshold":     sizeDirective("values larger than this are stored in the value log", func(cfg *Config) *int64 { return &cfg.Storage.ValueThreshold }),
+	"badger-value-log-file-size": sizeDirective("maximum size of a single value log file", func(cfg *Config) *int64 { return &cfg.Storage.ValueLogFileSize }),
+	"badger-block-cache-size":    sizeDirective("size of the block cache", func(cfg *Config) *int64 { return &cfg.Storage.BlockCacheSize }),
+	"badger-index-cache-size":    sizeDirective("size of the table index cache", func(cfg *Config) *int64 { return &cfg.Storage.IndexCacheSize }),
+	"badger-num-compactors":      intDirective("number of compaction workers", func(cfg *Config) *int { return &cfg.Storage.NumCompactors }),
+	"badger-compression":         enumDirective("table compression, none, snappy or zstd", func(cfg *Config) *string { return &cfg.Storage.Compression }, "none", "snappy", "zstd"),
+}
+
+func stringDirective(usage string, field func(*Config) *string) configDirective {
+	return configDirective{
+		usage: usage,
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			*field(cfg) = args[0]
+			return nil
+		},
+	}
+}
+
+func enumDirective(usage string, field func(*Config) *string, values ...string) configDirective {
+	return configDirective{
+		usage: usage,
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			value := strings.ToLower(args[0])
+			for _, allowed := range values {
+				if value == allowed {
+					*field(cfg) = value
+					return nil
+				}
+			}
+			return fmt.Errorf("invalid value '%s'", args[0])
+		},
+	}
+}
+
+func intDirective(usage string, field func(*Config) *int) configDirective {
+	return configDirective{
+		usage: usage,
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			value, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid number '%s'", args[0])
+			}
+			*field(cfg) = value
+			return nil
+		},
+	}
+}
+
+// minIntDirective is an intDirective which refuses values below min
+func minIntDirective(usage string, min int, field func(*Config) *int) configDirective {
+	directive := intDirective(usage, field)
+	set := directive.set
+	directive.set = func(cfg *Config, args []string) error {
+		value := *field(cfg)
+		err := set(cfg, args)
+		if err != nil {
+			return err
+		}
+		if *field(cfg) < min {
+			*field(cfg) = value
+			return fmt.Errorf("must be at least %d", min)
+		}
+		return nil
+	}
+	return directive
+}
+
+func sizeDirective(usage string, field func(*Config) *int64) configDirective {
+	return configDirective{
+		usage: usage,
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			value, err := parseMemory(args[0])
+			if err != nil {
+				return err
+			}
+			*field(cfg) = value
+			return nil
+		},
+	}
+}
+
+// boundedSizeDirective is a sizeDirective which refuses values outside of min and max
+func boundedSizeDirective(usage string, min, max int64, field func(*Config) *int64) configDirective {
+	directive := sizeDirective(usage, field)
+	set := directive.set
+	directive.set = func(cfg *Config, args []string) error {
+		value := *field(cfg)
+		err := set(cfg, args)
+		if err != nil {
+			return err
+		}
+		if *field(cfg) < min || *field(cfg) > max {
+			*field(cfg) = value
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return nil
+	}
+	return directive
+}
+
+func boolDirective(usage string, field func(*Config) *bool) configDirective {
+	return configDirective{
+		usage:  usage,
+		isBool: true,
+		set: func(cfg *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			switch strings.ToLower(args[0]) {
+			case "yes", "true":
+				*field(cfg) = true
+			case "no", "false":
+				*field(cfg) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+// setOutputBufferLimit parses `client-output-buffer-limit class hard soft seconds`, one
+// line can set several classes. Only the pubsub class is enforced, normal and replica
+// limits are checked and then ignored.
+func setOutputBufferLimit(cfg *Config, args []string) error {
+	if len(args) == 0 || len(args)%4 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	for i := 0; i < len(args); i += 4 {
+		class := strings.ToLower(args[i])
+		if class != "normal" && class != "replica" && class != "slave" && class != "pubsub" {
+			return fmt.Errorf("invalid client class '%s'", args[i])
+		}
+		hard, err := parseMemory(args[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := parseMemory(args[i+2])
+		if err != nil {
+			return err
+		}
+		seconds, err := strconv.Atoi(args[i+3])
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid number '%s'", args[i+3])
+		}
+		if class == "pubsub" {
+			cfg.PubSubOutputLimit = OutputBufferLimit{hard, soft, seconds}
+		}
+	}
+	return nil
+}
+
+func setLogLevel(cfg *Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	switch strings.ToLower(args[0]) {
+	case "debug", "verbose":
+		cfg.LogLevel = zapcore.DebugLevel
+	case "notice", "info":
+		cfg.LogLevel = zapcore.InfoLevel
+	case "warning", "warn":
+		cfg.LogLevel = zapcore.WarnLevel
+	case "error":
+		cfg.LogLevel = zapcore.ErrorLevel
+	default:
+		return fmt.Errorf("invalid log level '%s'", args[0])
+	}
+	return nil
+}
+
+// parseMemory converts sizes like 64mb or 1gb to bytes, `k`, `m` and `g` are powers
+// of 1000 and `kb`, `mb` and `gb` are powers of 1024, the same as redis.conf
+func parseMemory(str string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1024},
+		{"mb", 1024 * 1024},
+		{"gb", 1024 * 1024 * 1024},
+		{"k", 1000},
+		{"m", 1000 * 1000},
+		{"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(str)
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64/factor {
+		return 0, fmt.Errorf("invalid size '%s'", str)
+	}
+	return value * factor, nil
+}
+
+// directiveFlag records directives given on the command line, so they can be applied
+// after the config file and take precedence over it
+type directiveFlag struct {
+	name      string
+	directive configDirective
+	overrides *[][]string
+}
+
+func (f *directiveFlag) String() string {
+	return ""
+}
+
+func (f *directiveFlag) IsBoolFlag() bool {
+	return f.directive.isBool
+}
+
+func (f *directiveFlag) Set(value string) error {
+	args, err := splitArgs([]byte(value))
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		// -logfile "" means an empty argument, not a missing one
+		args = [][]byte{[]byte{}}
+	}
+	line := []string{f.name}
+	for _, arg := range args {
+		line = append(line, string(arg))
+	}
+
+	// Check the value right away so flag reports the error next to the flag name
+	cfg := defaultConfig()
+	err = f.directive.set(&cfg, line[1:])
+	if err != nil {
+		return err
+	}
+
+	*f.overrides = append(*f.overrides, line)
+	return nil
+}
+
+// loadConfig builds the configuration from defaults, then the config file given with
+// -config and finally the rest of the command line flags
+func loadConfig(name string, args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flagSet.String("config", "", "redis.conf style config file, flags take precedence over it")
+	overrides := [][]string{}
+	names := []string{}
+	for directiveName := range configDirectives {
+		names = append(names, directiveName)
+	}
+	sort.Strings(names)
+	for _, directiveName := range names {
+		directive := configDirectives[directiveName]
+		flagSet.Var(&directiveFlag{directiveName, directive, &overrides}, directiveName, directive.usage)
+	}
+
+	err := flagSet.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+	if flagSet.NArg() > 0 {
+		// flag stops at the first argument which is not a flag, the flags after it
+		// would be ignored. Boolean flags take their value as -flag=value.
+		flagSet.Usage()
+		return cfg, fmt.Errorf("unexpected argument '%s', boolean flags are set with -flag or -flag=value", flagSet.Arg(0))
+	}
+
+	if *configFile != "" {
+		err = cfg.LoadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, line := range overrides {
+		err = cfg.apply(line)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// LoadFile reads a redis.conf style file, one directive per line, arguments are separated
+// by spaces and can be quoted, lines starting with # are comments
+func (cfg *Config) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitArgs([]byte(line))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNumber, err.Error())
+		}
+		directive := []string{}
+		for _, arg := range args {
+			directive = append(directive, string(arg))
+		}
+		err = cfg.apply(directive)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNumber, err.Error())
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (cfg *Config) apply(line []string) error {
+	if len(line) == 0 {
+		return nil
+	}
+	name := strings.ToLower(line[0])
+	directive, ok := configDirectives[name]
+	if !ok {
+		return fmt.Errorf("unknown directive '%s'", line[0])
+	}
+
+	err := directive.set(cfg, line[1:])
+	if err != nil {
+		return fmt.Errorf("'%s': %s", name, err.Error())
+	}
+	return nil
+}
+
+func (cfg Config) Logger() (*zap.Logger, error) {
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = zap.NewAtomicLevelAt(cfg.LogLevel)
+	zapConfig.Encoding = cfg.LogFormat
+	zapConfig.Sampling = nil
+	if cfg.LogFormat == "console" {
+		zapConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	if cfg.LogFile != "" {
+		zapConfig.OutputPaths = []string{cfg.LogFile}
+		zapConfig.ErrorOutputPaths = []string{cfg.LogFile}
+	} else {
+		zapConfig.OutputPaths = []string{"stdout"}
+	}
+	return zapConfig.Build()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "atossa.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("# comment\nport 7000\nbind 127.0.0.1 ::1\ndir \"/tmp/my data\"\nsync-writes yes\nbadger-memtable-size 16mb\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("atossa", []string{"-port", "7001", "-config", file.Name(), "-in-memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := defaultConfig()
+	expected.Port = 7001
+	expected.Bind = []string{"127.0.0.1", "::1"}
+	expected.Storage.Dir = "/tmp/my data"
+	expected.Storage.SyncWrites = true
+	expected.Storage.InMemory = true
+	expected.Storage.MemTableSize = 16 * 1024 * 1024
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("Expected config=%+v\nActual config=%+v", expected, cfg)
+	}
+
+	_, err = loadConfig("atossa", []string{"-config", file.Name(), "-log-format", "xml"})
+	if err == nil {
+		t.Fatal("Expected an error for an invalid log format")
+	}
+
+	_, err = loadConfig("atossa", []string{"-config", file.Name(), "-list-chunk-size", "2gb"})
+	if err == nil {
+		t.Fatal("Expected an error for a too big list chunk size")
+	}
+
+	_, err = loadConfig("atossa", []string{"-in-memory", "yes", "-port", "6390"})
+	if err == nil {
+		t.Fatal("Expected an error for a positional argument")
+	}
+
+	_, err = loadConfig("atossa", []string{"-port", "6390", "extra"})
+	if err == nil {
+		t.Fatal("Expected an error for a trailing positional argument")
+	}
+
+	_, err = loadConfig("atossa", []string{"-config", file.Name(), "-shutdown-timeout", "-1"})
+	if err == nil {
+		t.Fatal("Expected an error for a negative shutdown timeout")
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	testCases := []struct {
+		title  string
+		str    string
+		result int64
+		valid  bool
+	}{
+		{"bytes", "100", 100, true},
+		{"binary unit", "16mb", 16 * 1024 * 1024, true},
+		{"decimal unit", "2k", 2000, true},
+		{"upper case", "1GB", 1024 * 1024 * 1024, true},
+		{"largest value", "9223372036854775807b", 9223372036854775807, true},
+		{"negative", "-1kb", 0, false},
+		{"not a number", "lots", 0, false},
+		{"overflow", "99999999999gb", 0, false},
+		{"overflow by one unit", "9223372036854776k", 0, false},
+	}
+
+	for _, testCase := range testCases {
+		result, err := parseMemory(testCase.str)
+		if result != testCase.result || (err == nil) != testCase.valid {
+			t.Fatalf("Case \"%s\":\n Expected result=%d, valid=%v\n Actual result=%d, err=%v", testCase.title, testCase.result, testCase.valid, result, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// globMatch tells whether str matches the glob style pattern the same way redis does.
+// A star matches any sequence of characters including none, a question mark matches any
+// single character, [abc] matches one of the characters, [^abc] any other character and
+// [a-z] a range. A backslash escapes the next character.
+func globMatch(pattern, str []byte) bool {
+	// starPattern is the pattern after the last star and starStr the input it was tried
+	// against. On a mismatch the star takes one more character and matching resumes
+	// from there, earlier stars never need to be revisited so this is O(len(pattern) *
+	// len(str)) instead of exponential.
+	var starPattern, starStr []byte
+	star := false
+	for {
+		if len(pattern) > 0 && pattern[0] == '*' {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			star, starPattern, starStr = true, pattern, str
+			continue
+		}
+		if len(pattern) == 0 && len(str) == 0 {
+			return true
+		}
+		if len(pattern) > 0 && len(str) > 0 {
+			matched, rest := globMatchChar(pattern, str[0])
+			if matched {
+				pattern, str = rest, str[1:]
+				continue
+			}
+		}
+		if !star || len(starStr) == 0 {
+			return false
+		}
+		starStr = starStr[1:]
+		pattern, str = starPattern, starStr
+	}
+}
+
+// globMatchChar matches char against the first element of the pattern, which is not a
+// star. It returns the rest of the pattern after that element.
+func globMatchChar(pattern []byte, char byte) (bool, []byte) {
+	switch pattern[0] {
+	case '?':
+		return true, pattern[1:]
+	case '[':
+		return globMatchClass(pattern[1:], char)
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return pattern[0] == char, pattern[1:]
+}
+
+// globMatchClass matches char against a [...] class, pattern starts right after the
+// opening bracket. It returns the rest of the pattern after the closing bracket.
+func globMatchClass(pattern []byte, char byte) (bool, []byte) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			if pattern[1] == char {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			if char >= low && char <= high {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == char {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		// skip the closing bracket, a missing one is treated as if it was there
+		pattern = pattern[1:]
+	}
+
+	return matched != negate, pattern
+}
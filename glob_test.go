@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1000", true},
+		{"user:*", "users", false},
+		{"*:name", "user:1:name", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[c-a]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"", "", true},
+		{"", "a", false},
+		{"a*", "a", true},
+		{"a*b", "a", false},
+		{"*a*b", "xaab", true},
+		{"h*\\*", "hello*", true},
+		{"h*[0-9]?", "hello12", true},
+		// backtracking over every star would take exponential time
+		{strings.Repeat("*a", 20) + "*b", strings.Repeat("a", 10000), false},
+	}
+
+	for _, testCase := range testCases {
+		match := globMatch([]byte(testCase.pattern), []byte(testCase.str))
+		if match != testCase.match {
+			t.Fatalf("Case \"%s\" \"%s\":\n Expected %v\n Actual %v", testCase.pattern, testCase.str, testCase.match, match)
+		}
+	}
+}
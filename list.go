@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	badger "github.com/dgraph-io/badger/v2"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 const internalListType = 'L'
 
+// listMetadataVersion follows the type of list metadata. Version 1 has 64 bit sizes,
+// metadata written before it had 32 bit sizes and no version, it loads the same way and
+// is rewritten with the version on the next write.
+const listMetadataVersion = '1'
+
 var ErrInvalidListMetadata = errors.New("Invalid list metadata")
+var ErrUnsupportedListMetadata = errors.New("Unsupported list metadata version")
+var ErrListSizeOverflow = errors.New("ERR list size overflow")
+var ErrListIndexOverflow = errors.New("ERR list index overflow")
 var ErrNilKey = errors.New("NILKEY Key is nil")
 var ErrInternalInvalidDirection = errors.New("INTERNAL Invalid direction")
 
@@ -24,15 +36,21 @@ const (
 type ListMetadata struct {
 	first int64
 	last  int64
-	size  uint32
+	size  int64
+	// quicklist is set for lists using the quicklist encoding
+	quicklist bool
 }
 
 func (lm ListMetadata) String() string {
 	firstStr := strconv.FormatInt(lm.first, 16)
 	lastStr := strconv.FormatInt(lm.last, 16)
-	size := strconv.FormatUint(uint64(lm.size), 16)
+	size := strconv.FormatInt(lm.size, 16)
 
-	str := append([]byte{internalListType}, ':')
+	listType := byte(internalListType)
+	if lm.quicklist {
+		listType = internalQuicklistType
+	}
+	str := []byte{listType, listMetadataVersion, ':'}
 	str = append(str, firstStr...)
 	str = append(str, ':')
 	str = append(str, lastStr...)
@@ -42,10 +60,41 @@ func (lm ListMetadata) String() string {
 	return string(str)
 }
 
+func (lm ListMetadata) encoding() string {
+	if lm.quicklist {
+		return listEncodingQuicklist
+	}
+	return listEncodingLinkedList
+}
+
+// checkGrowth returns an error when adding count elements to the list, or count indexes
+// to its head or tail for direction, would take its size or its first or last index past
+// the limits of int64. DirectionUnknown only checks the size. It is called before writing
+// so that a failed command leaves the list as it was.
+func (lm ListMetadata) checkGrowth(count int64, direction Direction) error {
+	if lm.size > math.MaxInt64-count {
+		return ErrListSizeOverflow
+	}
+	if direction == DirectionLeft && lm.first < math.MinInt64+count {
+		return ErrListIndexOverflow
+	}
+	if direction == DirectionRight && lm.last > math.MaxInt64-count {
+		return ErrListIndexOverflow
+	}
+	return nil
+}
+
 func UnmarshalListMetadata(data []byte) (interface{}, error) {
 	dataStr := string(data)
 	params := strings.Split(dataStr, ":")
-	if len(params) != 4 {
+	if len(params[0]) > 2 {
+		return nil, ErrInvalidListMetadata
+	}
+	if len(params[0]) == 2 && params[0][1] != listMetadataVersion {
+		return nil, ErrUnsupportedListMetadata
+	}
+	// the quicklist encoding came after the version, and has the same fields
+	if len(params) != 4 || (data[0] == internalQuicklistType && len(params[0]) != 2) {
 		return nil, ErrInvalidListMetadata
 	}
 	first, err := strconv.ParseInt(params[1], 16, 64)
@@ -56,175 +105,175 @@ func UnmarshalListMetadata(data []byte) (interface{}, error) {
 	if err != nil {
 		return nil, ErrInvalidListMetadata
 	}
-	size, err := strconv.ParseUint(params[3], 16, 64)
-	if err != nil {
+	size, err := strconv.ParseInt(params[3], 16, 64)
+	if err != nil || size < 0 {
+		return nil, ErrInvalidListMetadata
+	}
+	// the elements of both encodings are at the indexes from first to last
+	if uint64(last-first+1) != uint64(size) {
 		return nil, ErrInvalidListMetadata
 	}
 
-	return ListMetadata{first, last, uint32(size)}, nil
+	return ListMetadata{first, last, size, data[0] == internalQuicklistType}, nil
 }
 
-func listRange(key []byte, start, end int64) ([][]byte, error) {
-	internalKey := append([]byte(internalKeyPrefix), key...)
-
-	var values [][]byte
-	err := db.View(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
-		}
-		metadataItem, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			return nil
-		} else if err != nil {
-			return err
-		}
-
-		metadataRaw, err := metadataItem.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		metadata, err := UnmarshalMetadata(metadataRaw)
-		if err != nil {
-			return err
-		}
-		listMetadata, ok := metadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
-		}
+// listRangePositions converts the start and end offsets of LRANGE, which count from the
+// tail when negative, to positions from the head within the list. The range is empty when
+// end is before start.
+func listRangePositions(size, start, end int64) (int64, int64) {
+	if start < 0 {
+		start = size + start
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = size + end
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end
+}
 
-		if start < 0 {
-			start = listMetadata.last + start + 1
-		} else {
-			start = listMetadata.first + start
-		}
-		if start < listMetadata.first {
-			start = listMetadata.first
-		}
+func listRange(txn *badger.Txn, key []byte, start, end int64) ([][]byte, error) {
+	internalKey := append([]byte(internalKeyPrefix), key...)
 
-		if end < 0 {
-			end = listMetadata.last + end + 1
-		} else {
-			end = listMetadata.first + end
-		}
-		if end > listMetadata.last {
-			end = listMetadata.last
-		}
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return nil, ErrWrongType
+	}
+	metadataItem, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-		if end < start {
-			return nil
-		}
+	metadataRaw, err := metadataItem.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := UnmarshalMetadata(metadataRaw)
+	if err != nil {
+		return nil, err
+	}
+	listMetadata, ok := metadata.(ListMetadata)
+	if !ok {
+		return nil, ErrWrongType
+	}
 
-		itemKeyPrefix := append([]byte{}, internalKey...)
-		itemKeyPrefix = append(itemKeyPrefix, ':')
+	start, end = listRangePositions(int64(listMetadata.size), start, end)
+	if end < start {
+		return nil, nil
+	}
 
-		values = make([][]byte, end-start+1)
-		for index := start; index <= end; index++ {
-			itemId := strconv.FormatInt(index, 16)
-			itemKey := append(itemKeyPrefix, itemId...)
-			item, err := txn.Get(itemKey)
-			if err != nil {
-				return err
-			}
-			values[index-start], err = item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+	values := make([][]byte, 0, end-start+1)
+	err = listWalkElements(txn, key, listMetadata, start, end, false, func(position int64, value []byte) (bool, error) {
+		values = append(values, value)
+		return true, nil
 	})
-
-	return values, err
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(values)) != end-start+1 {
+		return nil, ErrInvalidListMetadata
+	}
+	return values, nil
 }
 
-func listPop(key []byte, direction Direction) ([]byte, error) {
+// listPop removes an element from one end of the list. The boolean is false when the list
+// does not exist, empty elements are returned as nil so it is the only way to tell.
+func listPop(txn *badger.Txn, key []byte, direction Direction) ([]byte, bool, error) {
 	internalKey := append([]byte(internalKeyPrefix), key...)
 
-	var value []byte = nil
-	err := db.Update(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
-		}
-
-		metadataItem, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			return nil
-		} else if err != nil {
-			return err
-		}
-		metadataRaw, err := metadataItem.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		metadata, err := UnmarshalMetadata(metadataRaw)
-		if err != nil {
-			return err
-		}
-		listMetadata, ok := metadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
-		}
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return nil, false, ErrWrongType
+	}
 
-		var itemId string
-		if direction == DirectionLeft {
-			itemId = strconv.FormatInt(listMetadata.first, 16)
-			listMetadata.first++
-			listMetadata.size--
-		} else {
-			itemId = strconv.FormatInt(listMetadata.last, 16)
-			listMetadata.last--
-			listMetadata.size--
-		}
-		itemKey := append([]byte{}, internalKey...)
-		itemKey = append(itemKey, ':')
-		itemKey = append(itemKey, itemId...)
-		item, err := txn.Get(itemKey)
+	metadataItem, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	metadataRaw, err := metadataItem.ValueCopy(nil)
+	if err != nil {
+		return nil, false, err
+	}
+	metadata, err := UnmarshalMetadata(metadataRaw)
+	if err != nil {
+		return nil, false, err
+	}
+	listMetadata, ok := metadata.(ListMetadata)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	if listMetadata.quicklist {
+		values, _, err := quicklistPop(txn, key, listMetadata, direction, 1)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
+		return values[0], true, nil
+	}
 
-		value, err = item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		err = txn.Delete(itemKey)
-		if err != nil {
-			return err
-		}
+	var itemKey []byte
+	if direction == DirectionLeft {
+		itemKey = listItemKey(key, listMetadata.first)
+		listMetadata.first++
+		listMetadata.size--
+	} else {
+		itemKey = listItemKey(key, listMetadata.last)
+		listMetadata.last--
+		listMetadata.size--
+	}
+	item, err := txn.Get(itemKey)
+	if err != nil {
+		return nil, false, err
+	}
 
-		if listMetadata.size == 0 {
-			err = txn.Delete(internalKey)
-			return err
-		}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, false, err
+	}
+	err = txn.Delete(itemKey)
+	if err != nil {
+		return nil, false, err
+	}
 
+	if listMetadata.size == 0 {
+		err = txn.Delete(internalKey)
+	} else {
 		err = txn.Set(internalKey, []byte(listMetadata.String()))
-		return err
-	})
-
-	return value, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
 }
 
 func listCreate(txn *badger.Txn, key []byte, values [][]byte) error {
 	if values == nil {
 		values = [][]byte{[]byte{}}
 	}
+	if atomic.LoadInt32(&newListsChunked) != 0 {
+		_, err := quicklistCreate(txn, key, values)
+		return err
+	}
 	internalKey := append([]byte(internalKeyPrefix), key...)
-	itemKeyPrefix := append([]byte(internalKey), ':')
 
 	size := len(values)
-	metadata := ListMetadata{0, int64(size - 1), uint32(size)}
+	metadata := ListMetadata{0, int64(size - 1), int64(size), false}
 	err := txn.Set(internalKey, []byte(metadata.String()))
 	if err != nil {
 		return err
 	}
 
 	for idx, value := range values {
-		itemId := strconv.FormatUint(uint64(idx), 16)
-		itemKey := append(itemKeyPrefix, itemId...)
-		err = txn.Set(itemKey, value)
+		err = txn.Set(listItemKey(key, int64(idx)), value)
 		if err != nil {
 			return err
 		}
@@ -232,7 +281,7 @@ func listCreate(txn *badger.Txn, key []byte, values [][]byte) error {
 	return nil
 }
 
-func listPush(key []byte, values [][]byte, direction Direction) (uint32, error) {
+func listPush(txn *badger.Txn, key []byte, values [][]byte, direction Direction) (int64, error) {
 	if len(key) == 0 {
 		return 0, ErrNilKey
 	}
@@ -242,233 +291,728 @@ func listPush(key []byte, values [][]byte, direction Direction) (uint32, error)
 
 	internalKey := append([]byte(internalKeyPrefix), key...)
 
-	size := uint32(0)
-
-	err := db.Update(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
-		}
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return 0, ErrWrongType
+	}
 
-		item, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			size = uint32(len(values))
-			if values == nil {
-				size = 1
-			}
-			return listCreate(txn, key, values)
-		} else if err != nil {
-			return err
+	item, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		size := int64(len(values))
+		if values == nil {
+			size = 1
 		}
+		return size, listCreate(txn, key, values)
+	} else if err != nil {
+		return 0, err
+	}
 
-		metadataVal, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		readMetadata, err := UnmarshalMetadata(metadataVal)
+	metadataVal, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	readMetadata, err := UnmarshalMetadata(metadataVal)
+	if err != nil {
+		return 0, err
+	}
+	var ok bool
+	metadata, ok := readMetadata.(ListMetadata)
+	if !ok {
+		return 0, ErrWrongType
+	}
+	err = metadata.checkGrowth(int64(len(values)), direction)
+	if err != nil {
+		return 0, err
+	}
+	if metadata.quicklist {
+		metadata, err = quicklistPush(txn, key, metadata, values, direction)
 		if err != nil {
-			return err
-		}
-		var ok bool
-		metadata, ok := readMetadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
+			return 0, err
 		}
+		return metadata.size, listSetMetadata(txn, key, metadata)
+	}
 
-		var start, step int
-		var condition func(int) bool
+	var start, step int
+	var condition func(int) bool
+	if direction == DirectionLeft {
+		start = len(values) - 1
+		step = -1
+		condition = func(i int) bool { return i >= 0 }
+	} else {
+		start = 0
+		step = 1
+		condition = func(i int) bool { return i < len(values) }
+	}
+	for i := start; condition(i); i += step {
+		var index int64
 		if direction == DirectionLeft {
-			start = len(values) - 1
-			step = -1
-			condition = func(i int) bool { return i >= 0 }
+			metadata.first--
+			index = metadata.first
 		} else {
-			start = 0
-			step = 1
-			condition = func(i int) bool { return i < len(values) }
+			metadata.last++
+			index = metadata.last
 		}
-		for i := start; condition(i); i += step {
-			var itemId string
-			if direction == DirectionLeft {
-				metadata.first--
-				itemId = strconv.FormatInt(metadata.first, 16)
-			} else {
-				metadata.last++
-				itemId = strconv.FormatInt(metadata.last, 16)
-			}
-			metadata.size++
+		metadata.size++
+
+		err = txn.Set(listItemKey(key, index), values[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = txn.Set(internalKey, []byte(metadata.String()))
+	if err != nil {
+		return 0, err
+	}
 
-			size = metadata.size
+	return metadata.size, nil
+}
 
-			itemKey := append([]byte{}, internalKey...)
-			itemKey = append(itemKey, ':')
-			itemKey = append(itemKey, itemId...)
+func listLength(txn *badger.Txn, key []byte) (int64, error) {
+	internalKey := append([]byte(internalKeyPrefix), key...)
 
-			err = txn.Set(itemKey, values[i])
-			if err != nil {
-				return err
-			}
-		}
-		err = txn.Set(internalKey, []byte(metadata.String()))
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return 0, ErrWrongType
+	}
 
-		return err
-	})
+	item, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
 
-	return size, err
+	metadataVal, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	readMetadata, err := UnmarshalMetadata(metadataVal)
+	if err != nil {
+		return 0, err
+	}
+	var ok bool
+	metadata, ok := readMetadata.(ListMetadata)
+	if !ok {
+		return 0, ErrWrongType
+	}
+
+	return metadata.size, nil
 }
 
-func listLength(key []byte) (uint32, error) {
+// listIndex returns the element at index, negative indexes count from the tail. Like
+// listPop, empty elements may be returned as nil and the boolean is false when index is
+// out of range.
+func listIndex(txn *badger.Txn, key []byte, index int64) ([]byte, bool, error) {
 	internalKey := append([]byte(internalKeyPrefix), key...)
 
-	length := uint32(0)
-	err := db.View(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return nil, false, ErrWrongType
+	}
+
+	item, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, false, errors.New("ERR no such key")
+	} else if err != nil {
+		return nil, false, err
+	}
+	metadataVal, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, false, err
+	}
+	readMetadata, err := UnmarshalMetadata(metadataVal)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	metadata, ok := readMetadata.(ListMetadata)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+
+	if index >= metadata.size || index < -metadata.size {
+		// index out of range
+		return nil, false, nil
+	}
+	if metadata.quicklist {
+		if index < 0 {
+			index += metadata.size
 		}
+		value, err := quicklistIndex(txn, key, metadata, index)
+		return value, err == nil, err
+	}
 
-		item, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			return nil
-		} else if err != nil {
-			return err
+	if index < 0 {
+		index = metadata.last + index + 1
+	} else {
+		index = metadata.first + index
+	}
+
+	value, err := listGetItem(txn, key, index)
+	return value, err == nil, err
+}
+
+func listSet(txn *badger.Txn, key, value []byte, index int64) error {
+	internalKey := append([]byte(internalKeyPrefix), key...)
+
+	// Ensure there is no simple string key with the same name exists
+	_, err := txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return ErrWrongType
+	}
+
+	item, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return errors.New("ERR no such key")
+	} else if err != nil {
+		return err
+	}
+	metadataVal, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	readMetadata, err := UnmarshalMetadata(metadataVal)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	metadata, ok := readMetadata.(ListMetadata)
+	if !ok {
+		return ErrWrongType
+	}
+
+	if index >= metadata.size || index < -metadata.size {
+		return ErrIndexOutOfRange
+	}
+	// the metadata is written again although it did not change, so that it gets a new
+	// version like with every other write to the list, which is what WATCH compares
+	err = txn.Set(internalKey, metadataVal)
+	if err != nil {
+		return err
+	}
+	if metadata.quicklist {
+		if index < 0 {
+			index += metadata.size
 		}
+		return quicklistSet(txn, key, metadata, index, value)
+	}
 
-		metadataVal, err := item.ValueCopy(nil)
+	if index < 0 {
+		index = metadata.last + index + 1
+	} else {
+		index = metadata.first + index
+	}
+
+	return txn.Set(listItemKey(key, index), value)
+}
+
+// listGetMetadata reads the metadata of the list at key, ok is false when the key does
+// not exist
+func listGetMetadata(txn *badger.Txn, key []byte) (metadata ListMetadata, ok bool, err error) {
+	internalKey := append([]byte(internalKeyPrefix), key...)
+
+	// Ensure there is no simple string key with the same name exists
+	_, err = txn.Get(key)
+	if err != badger.ErrKeyNotFound {
+		return metadata, false, ErrWrongType
+	}
+
+	item, err := txn.Get(internalKey)
+	if err == badger.ErrKeyNotFound {
+		return metadata, false, nil
+	} else if err != nil {
+		return metadata, false, err
+	}
+	metadataVal, err := item.ValueCopy(nil)
+	if err != nil {
+		return metadata, false, err
+	}
+	readMetadata, err := UnmarshalMetadata(metadataVal)
+	if err != nil {
+		return metadata, false, err
+	}
+	metadata, ok = readMetadata.(ListMetadata)
+	if !ok {
+		return metadata, false, ErrWrongType
+	}
+	return metadata, true, nil
+}
+
+// listIndexLen is the length of the index at the end of list element keys
+const listIndexLen = 8
+
+// listItemKeyPrefix starts the element keys of every list. They are kept apart from the
+// metadata keys under internalKeyPrefix, otherwise the metadata key of a list named
+// key: followed by 8 bytes would be the element key of the list at key.
+const listItemKeyPrefix = "$$$l"
+
+// listItemPrefix is the prefix shared by the element keys of the list at key
+func listItemPrefix(key []byte) []byte {
+	prefix := make([]byte, 0, len(listItemKeyPrefix)+len(key)+1+listIndexLen)
+	prefix = append(prefix, listItemKeyPrefix...)
+	prefix = append(prefix, key...)
+	return append(prefix, ':')
+}
+
+// listItemKey is the key of the element at index. The index is stored big endian with
+// its sign bit flipped, so the element keys of a list sort in list order.
+func listItemKey(key []byte, index int64) []byte {
+	var encoded [listIndexLen]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(index)^(1<<63))
+	return append(listItemPrefix(key), encoded[:]...)
+}
+
+// listWalk calls fn with the elements of the list at key whose index is between start
+// and end, both included, walking the element keys with a single prefix iterator instead
+// of getting each of them. The walk goes from the tail to the head when reverse is set,
+// it stops as soon as fn returns false.
+func listWalk(txn *badger.Txn, key []byte, start, end int64, reverse bool, fn func(index int64, value []byte) (bool, error)) error {
+	return listIterate(txn, key, start, end, reverse, true, func(index int64, item *badger.Item) (bool, error) {
+		value, err := item.ValueCopy(nil)
 		if err != nil {
-			return err
+			return false, err
 		}
-		readMetadata, err := UnmarshalMetadata(metadataVal)
-		if err != nil {
+		return fn(index, value)
+	})
+}
+
+// listIterate is listWalk giving the badger items, their values are only prefetched when
+// prefetch is set
+func listIterate(txn *badger.Txn, key []byte, start, end int64, reverse, prefetch bool, fn func(index int64, item *badger.Item) (bool, error)) error {
+	if end < start {
+		return nil
+	}
+	prefix := listItemPrefix(key)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.Reverse = reverse
+	opts.PrefetchValues = prefetch
+	if end-start+1 < int64(opts.PrefetchSize) {
+		opts.PrefetchSize = int(end - start + 1)
+	}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	from, to := listItemKey(key, start), listItemKey(key, end)
+	if reverse {
+		from, to = to, from
+	}
+	for it.Seek(from); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		itemKey := item.Key()
+		if len(itemKey) != len(prefix)+listIndexLen {
+			// a key of another list whose name starts with this one and a colon
+			continue
+		}
+		if (!reverse && bytes.Compare(itemKey, to) > 0) || (reverse && bytes.Compare(itemKey, to) < 0) {
+			break
+		}
+		index := int64(binary.BigEndian.Uint64(itemKey[len(prefix):]) ^ (1 << 63))
+		more, err := fn(index, item)
+		if err != nil || !more {
 			return err
 		}
-		var ok bool
-		metadata, ok := readMetadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
-		}
+	}
+	return nil
+}
 
-		length = metadata.size
+// listWalkElements calls fn with the elements of the list between positions start and
+// end, both included and counted from the head, whatever the encoding of the list. It
+// walks from the tail to the head when reverse is set and stops when fn returns false.
+func listWalkElements(txn *badger.Txn, key []byte, metadata ListMetadata, start, end int64, reverse bool, fn func(position int64, value []byte) (bool, error)) error {
+	if end < start {
 		return nil
+	}
+	if metadata.quicklist {
+		return quicklistWalk(txn, key, metadata, start, end, reverse, fn)
+	}
+	return listWalk(txn, key, metadata.first+start, metadata.first+end, reverse, func(index int64, value []byte) (bool, error) {
+		return fn(index-metadata.first, value)
 	})
+}
 
-	return length, err
+// listCheckRangeSize reads the elements between positions start and end without keeping
+// them, and fails with ErrReplyTooLarge as soon as their reply goes over maxSize
+func listCheckRangeSize(txn *badger.Txn, key []byte, metadata ListMetadata, start, end, maxSize int64) error {
+	size := int64(0)
+	return listWalkElements(txn, key, metadata, start, end, false, func(position int64, value []byte) (bool, error) {
+		size += bulkSize(value)
+		if size > maxSize {
+			return false, ErrReplyTooLarge
+		}
+		return true, nil
+	})
 }
 
-func listIndex(key []byte, index int64) ([]byte, error) {
-	internalKey := append([]byte(internalKeyPrefix), key...)
+// listDelete deletes the list at key with all its elements, it does nothing if the key
+// does not exist
+func listDelete(txn *badger.Txn, key []byte) error {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
+		return err
+	}
+	err = listWalk(txn, key, metadata.first, metadata.last, false, func(index int64, value []byte) (bool, error) {
+		return true, txn.Delete(listItemKey(key, index))
+	})
+	if err != nil {
+		return err
+	}
+	return txn.Delete(append([]byte(internalKeyPrefix), key...))
+}
 
-	var val []byte
+func listGetItem(txn *badger.Txn, key []byte, index int64) ([]byte, error) {
+	item, err := txn.Get(listItemKey(key, index))
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
 
-	err := db.View(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
-		}
+// listSetMetadata stores metadata, or deletes the list when it is empty
+func listSetMetadata(txn *badger.Txn, key []byte, metadata ListMetadata) error {
+	internalKey := append([]byte(internalKeyPrefix), key...)
+	if metadata.size == 0 {
+		return txn.Delete(internalKey)
+	}
+	return txn.Set(internalKey, []byte(metadata.String()))
+}
 
-		item, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			return errors.New("ERR no such key")
-		} else if err != nil {
-			return err
+// listInsert inserts value before or after the first element equal to pivot. The
+// elements between the insertion point and the closest end of the list are moved by
+// one to make room. It returns the new size of the list, 0 if it does not exist and -1
+// if pivot was not found.
+func listInsert(txn *badger.Txn, key, pivot, value []byte, before bool) (int64, error) {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	position := int64(-1)
+	err = listWalkElements(txn, key, metadata, 0, metadata.size-1, false, func(index int64, element []byte) (bool, error) {
+		if bytes.Equal(element, pivot) {
+			position = index
+			return false, nil
 		}
-		metadataVal, err := item.ValueCopy(nil)
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if position < 0 {
+		return -1, nil
+	}
+	if !before {
+		position++
+	}
+	if metadata.quicklist {
+		metadata, err = quicklistInsert(txn, key, metadata, position, value)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		readMetadata, err := UnmarshalMetadata(metadataVal)
-		if err != nil {
-			return err
+		return metadata.size, listSetMetadata(txn, key, metadata)
+	}
+	position += metadata.first
+
+	left := position-metadata.first < metadata.last+1-position
+	direction := DirectionRight
+	if left {
+		direction = DirectionLeft
+	}
+	err = metadata.checkGrowth(1, direction)
+	if err != nil {
+		return 0, err
+	}
+	if left {
+		// move the elements before the insertion point to the left
+		for index := metadata.first; index < position; index++ {
+			element, err := listGetItem(txn, key, index)
+			if err != nil {
+				return 0, err
+			}
+			err = txn.Set(listItemKey(key, index-1), element)
+			if err != nil {
+				return 0, err
+			}
 		}
-		var ok bool
-		metadata, ok := readMetadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
+		metadata.first--
+		position--
+	} else {
+		// move the elements from the insertion point to the right
+		for index := metadata.last; index >= position; index-- {
+			element, err := listGetItem(txn, key, index)
+			if err != nil {
+				return 0, err
+			}
+			err = txn.Set(listItemKey(key, index+1), element)
+			if err != nil {
+				return 0, err
+			}
 		}
+		metadata.last++
+	}
+	metadata.size++
 
-		if index >= int64(metadata.size) || index < -int64(metadata.size) {
-			// index out of range
-			return nil
-		}
+	err = txn.Set(listItemKey(key, position), value)
+	if err != nil {
+		return 0, err
+	}
+	return metadata.size, listSetMetadata(txn, key, metadata)
+}
 
-		if index < 0 {
-			index = metadata.last + index + 1
-		} else {
-			index = metadata.first + index
+// listRemove removes the elements equal to value, the first count ones from the head
+// when count is positive, the last -count ones from the tail when it is negative and all
+// of them when it is 0. The walk stops once count elements are found, the elements on
+// the shorter side of the removed ones are then moved to fill the gaps, in txn like the
+// removed ones so it fails with badger.ErrTxnTooBig when they are too many. It returns
+// how many elements were removed.
+func listRemove(txn *badger.Txn, key, value []byte, count int64) (int64, error) {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	reverse := count < 0
+	if metadata.quicklist {
+		var removedCount int64
+		removedCount, metadata, err = quicklistRemove(txn, key, metadata, value, reverse, limit)
+		if err != nil || removedCount == 0 {
+			return 0, err
+		}
+		return removedCount, listSetMetadata(txn, key, metadata)
+	}
+
+	removed := []int64{}
+	err = listWalk(txn, key, metadata.first, metadata.last, reverse, func(index int64, element []byte) (bool, error) {
+		if bytes.Equal(element, value) {
+			removed = append(removed, index)
 		}
+		return limit == 0 || int64(len(removed)) < limit, nil
+	})
+	if err != nil || len(removed) == 0 {
+		return 0, err
+	}
+	if reverse {
+		reverseIndexes(removed)
+	}
+	metadata.first, metadata.last, err = listCloseGaps(txn, key, metadata.first, metadata.last, removed)
+	if err != nil {
+		return 0, err
+	}
+	metadata.size -= int64(len(removed))
+	return int64(len(removed)), listSetMetadata(txn, key, metadata)
+}
 
-		itemId := strconv.FormatInt(index, 16)
+// listCloseGaps deletes the element keys of the list at key whose indexes are in
+// removed, sorted in ascending order, and moves the keys between first and last so they
+// stay contiguous. Only the keys on the shorter side of the removed ones are moved. It
+// returns the new first and last indexes.
+func listCloseGaps(txn *badger.Txn, key []byte, first, last int64, removed []int64) (int64, int64, error) {
+	removedCount := int64(len(removed))
+	if removed[removedCount-1]-first < last-removed[0] {
+		// move the keys before the last removed one to the right
+		shift, next := int64(0), removedCount-1
+		err := listWalk(txn, key, first, removed[removedCount-1], true, func(index int64, element []byte) (bool, error) {
+			if next >= 0 && index == removed[next] {
+				shift++
+				next--
+				return true, nil
+			}
+			return true, txn.Set(listItemKey(key, index+shift), element)
+		})
+		if err != nil {
+			return first, last, err
+		}
+		for index := first; index < first+removedCount; index++ {
+			err = txn.Delete(listItemKey(key, index))
+			if err != nil {
+				return first, last, err
+			}
+		}
+		return first + removedCount, last, nil
+	}
 
-		itemKey := append([]byte{}, internalKey...)
-		itemKey = append(itemKey, ':')
-		itemKey = append(itemKey, itemId...)
-		item, err = txn.Get(itemKey)
+	// move the keys after the first removed one to the left
+	shift, next := int64(0), int64(0)
+	err := listWalk(txn, key, removed[0], last, false, func(index int64, element []byte) (bool, error) {
+		if next < removedCount && index == removed[next] {
+			shift++
+			next++
+			return true, nil
+		}
+		return true, txn.Set(listItemKey(key, index-shift), element)
+	})
+	if err != nil {
+		return first, last, err
+	}
+	for index := last - removedCount + 1; index <= last; index++ {
+		err = txn.Delete(listItemKey(key, index))
 		if err != nil {
-			return err
+			return first, last, err
 		}
+	}
+	return first, last - removedCount, nil
+}
 
-		val, err = item.ValueCopy(nil)
+func reverseIndexes(indexes []int64) {
+	for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+		indexes[i], indexes[j] = indexes[j], indexes[i]
+	}
+}
+
+// listTrim keeps the elements between start and end, both included. Negative offsets
+// count from the tail, the list is deleted when the range is empty. Every element key
+// trimmed is deleted in txn, which fails with badger.ErrTxnTooBig when it cannot hold
+// them all.
+func listTrim(txn *badger.Txn, key []byte, start, end int64) error {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
 		return err
-	})
+	}
+
+	size := metadata.size
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+
+	if start > end || start >= size {
+		// nothing is kept
+		return listDelete(txn, key)
+	}
+	if metadata.quicklist {
+		return quicklistTrim(txn, key, metadata, start, end)
+	}
 
+	first := metadata.first + start
+	last := metadata.first + end
+	deleteItem := func(index int64, value []byte) (bool, error) {
+		return true, txn.Delete(listItemKey(key, index))
+	}
+	err = listWalk(txn, key, metadata.first, first-1, false, deleteItem)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	err = listWalk(txn, key, last+1, metadata.last, false, deleteItem)
+	if err != nil {
+		return err
 	}
+	return listSetMetadata(txn, key, ListMetadata{first, last, last - first + 1, false})
+}
 
-	return val, nil
+// listMove pops an element from the from end of source and pushes it to the to end of
+// destination in the same transaction, so it cannot be lost in between. Source and
+// destination can be the same list to rotate it. Like listPop, the boolean is false when
+// source is empty.
+func listMove(txn *badger.Txn, source, destination []byte, from, to Direction) ([]byte, bool, error) {
+	_, ok, err := listGetMetadata(txn, source)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	// nothing is popped when the destination is not a list
+	_, _, err = listGetMetadata(txn, destination)
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, found, err := listPop(txn, source, from)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	_, err = listPush(txn, destination, [][]byte{value}, to)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
 }
 
-func listSet(key, value []byte, index int64) error {
-	internalKey := append([]byte(internalKeyPrefix), key...)
+// listPopCount pops up to count elements from one end of the list in a single
+// transaction, it returns nil if the list does not exist
+func listPopCount(txn *badger.Txn, key []byte, direction Direction, count int64) ([][]byte, error) {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
+		return nil, err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		// Ensure there is no simple string key with the same name exists
-		_, err := txn.Get(key)
-		if err != badger.ErrKeyNotFound {
-			return ErrWrongType
-		}
+	if metadata.quicklist {
+		values, _, err := quicklistPop(txn, key, metadata, direction, count)
+		return values, err
+	}
 
-		item, err := txn.Get(internalKey)
-		if err == badger.ErrKeyNotFound {
-			return errors.New("ERR no such key")
-		} else if err != nil {
-			return err
+	if count > metadata.size {
+		count = metadata.size
+	}
+	values := make([][]byte, 0, count)
+	for i := int64(0); i < count; i++ {
+		index := metadata.first
+		if direction == DirectionLeft {
+			metadata.first++
+		} else {
+			index = metadata.last
+			metadata.last--
 		}
-		metadataVal, err := item.ValueCopy(nil)
+		metadata.size--
+
+		value, err := listGetItem(txn, key, index)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		readMetadata, err := UnmarshalMetadata(metadataVal)
+		err = txn.Delete(listItemKey(key, index))
 		if err != nil {
-			return err
-		}
-		var ok bool
-		metadata, ok := readMetadata.(ListMetadata)
-		if !ok {
-			return ErrWrongType
+			return nil, err
 		}
+		values = append(values, value)
+	}
+	return values, listSetMetadata(txn, key, metadata)
+}
 
-		if index >= int64(metadata.size) || index < -int64(metadata.size) {
-			return ErrIndexOutOfRange
-		}
+// listPositions returns the positions, from the head, of the elements equal to value.
+// A positive rank skips the first rank-1 matches from the head, a negative one searches
+// from the tail and skips the first -rank-1 matches from there. At most count positions
+// are returned and at most maxLen elements are compared, 0 means no limit for both.
+func listPositions(txn *badger.Txn, key, value []byte, rank, count, maxLen int64) ([]int64, error) {
+	metadata, ok, err := listGetMetadata(txn, key)
+	if err != nil || !ok {
+		return nil, err
+	}
 
-		if index < 0 {
-			index = metadata.last + index + 1
-		} else {
-			index = metadata.first + index
+	skip := rank - 1
+	size := metadata.size
+	start, end := int64(0), size-1
+	if maxLen > 0 && maxLen < size {
+		end = maxLen - 1
+	}
+	if rank < 0 {
+		skip = -rank - 1
+		if maxLen > 0 && maxLen < size {
+			start, end = size-maxLen, size-1
 		}
-
-		itemId := strconv.FormatInt(index, 16)
-
-		itemKey := append([]byte{}, internalKey...)
-		itemKey = append(itemKey, ':')
-		itemKey = append(itemKey, itemId...)
-		err = txn.Set(itemKey, value)
-
-		return err
+	}
+	positions := []int64{}
+	err = listWalkElements(txn, key, metadata, start, end, rank < 0, func(position int64, element []byte) (bool, error) {
+		if !bytes.Equal(element, value) {
+			return true, nil
+		}
+		if skip > 0 {
+			skip--
+			return true, nil
+		}
+		positions = append(positions, position)
+		return count == 0 || int64(len(positions)) < count, nil
 	})
-
-	return err
+	return positions, err
 }
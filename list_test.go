@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	badger "github.com/dgraph-io/badger/v2"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +14,7 @@ func TestListPush(t *testing.T) {
 		key          []byte
 		values       [][]byte
 		direction    Direction
-		result       uint32
+		result       int64
 		err          error
 		dataset      [][]byte
 		flushDataset bool
@@ -46,12 +48,12 @@ func TestListPush(t *testing.T) {
 			[]byte{'k', 'e', 'y'},
 			nil,
 			DirectionLeft,
-			uint32(1),
+			int64(1),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '0', ':', '1'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '0', ':', '1'},
+				listItemKey([]byte("key"), 0),
 				nil,
 			},
 			true,
@@ -63,12 +65,12 @@ func TestListPush(t *testing.T) {
 				[]byte{'v', 'a', 'l'},
 			},
 			DirectionLeft,
-			uint32(1),
+			int64(1),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '0', ':', '1'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '0', ':', '1'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'v', 'a', 'l'},
 			},
 			true,
@@ -81,14 +83,14 @@ func TestListPush(t *testing.T) {
 				[]byte{'b', 'a', 'r'},
 			},
 			DirectionLeft,
-			uint32(2),
+			int64(2),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '1', ':', '2'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '1', ':', '2'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '1'},
+				listItemKey([]byte("key"), 1),
 				[]byte{'b', 'a', 'r'},
 			},
 			true,
@@ -100,12 +102,12 @@ func TestListPush(t *testing.T) {
 				[]byte{'v', 'a', 'l'},
 			},
 			DirectionRight,
-			uint32(1),
+			int64(1),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '0', ':', '1'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '0', ':', '1'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'v', 'a', 'l'},
 			},
 			true,
@@ -118,14 +120,14 @@ func TestListPush(t *testing.T) {
 				[]byte{'b', 'a', 'r'},
 			},
 			DirectionRight,
-			uint32(2),
+			int64(2),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '1', ':', '2'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '1', ':', '2'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '1'},
+				listItemKey([]byte("key"), 1),
 				[]byte{'b', 'a', 'r'},
 			},
 			true,
@@ -137,12 +139,12 @@ func TestListPush(t *testing.T) {
 				[]byte{'f', 'o', 'o'},
 			},
 			DirectionLeft,
-			uint32(1),
+			int64(1),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '0', ':', '1'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '0', ':', '1'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
 			},
 			true,
@@ -154,14 +156,14 @@ func TestListPush(t *testing.T) {
 				[]byte{'b', 'a', 'r'},
 			},
 			DirectionLeft,
-			uint32(2),
+			int64(2),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '-', '1', ':', '0', ':', '2'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '-', '1'},
+				[]byte{'L', '1', ':', '-', '1', ':', '0', ':', '2'},
+				listItemKey([]byte("key"), -1),
 				[]byte{'b', 'a', 'r'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
 			},
 			false,
@@ -173,12 +175,12 @@ func TestListPush(t *testing.T) {
 				[]byte{'f', 'o', 'o'},
 			},
 			DirectionRight,
-			uint32(1),
+			int64(1),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '0', ':', '1'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '0', ':', '1'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
 			},
 			true,
@@ -190,14 +192,14 @@ func TestListPush(t *testing.T) {
 				[]byte{'b', 'a', 'r'},
 			},
 			DirectionRight,
-			uint32(2),
+			int64(2),
 			nil,
 			[][]byte{
 				[]byte{'$', '$', '$', '_', 'k', 'e', 'y'},
-				[]byte{'L', ':', '0', ':', '1', ':', '2'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '0'},
+				[]byte{'L', '1', ':', '0', ':', '1', ':', '2'},
+				listItemKey([]byte("key"), 0),
 				[]byte{'f', 'o', 'o'},
-				[]byte{'$', '$', '$', '_', 'k', 'e', 'y', ':', '1'},
+				listItemKey([]byte("key"), 1),
 				[]byte{'b', 'a', 'r'},
 			},
 			false,
@@ -213,7 +215,12 @@ func TestListPush(t *testing.T) {
 			}
 		}
 
-		actualResult, actualErr := listPush(testCase.key, testCase.values, testCase.direction)
+		var actualResult int64
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			var err error
+			actualResult, err = listPush(txn, testCase.key, testCase.values, testCase.direction)
+			return err
+		})
 
 		txn := db.NewTransaction(false)
 		defer txn.Discard()
@@ -235,3 +242,1073 @@ func TestListPush(t *testing.T) {
 		}
 	}
 }
+
+// listDataset returns every key in the database followed by its value
+func listDataset(t *testing.T) [][]byte {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	dataset := [][]byte{}
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataset = append(dataset, item.KeyCopy(nil), value)
+	}
+	return dataset
+}
+
+// createTestList replaces the database content with a list at key
+func createTestList(t *testing.T, key []byte, values [][]byte) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		_, err := listPush(txn, key, values, DirectionRight)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListInsert(t *testing.T) {
+	testCases := []struct {
+		title   string
+		key     []byte
+		pivot   []byte
+		value   []byte
+		before  bool
+		result  int64
+		err     error
+		dataset [][]byte
+	}{
+		{
+			"before the first element",
+			[]byte("key"),
+			[]byte("a"),
+			[]byte("x"),
+			true,
+			4,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:-1:2:4"),
+				listItemKey([]byte("key"), -1), []byte("x"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"after the first element moves it to the left",
+			[]byte("key"),
+			[]byte("a"),
+			[]byte("x"),
+			false,
+			4,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:-1:2:4"),
+				listItemKey([]byte("key"), -1), []byte("a"),
+				listItemKey([]byte("key"), 0), []byte("x"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"before the last element moves it to the right",
+			[]byte("key"),
+			[]byte("c"),
+			[]byte("x"),
+			true,
+			4,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:3:4"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("x"),
+				listItemKey([]byte("key"), 3), []byte("c"),
+			},
+		},
+		{
+			"missing pivot",
+			[]byte("key"),
+			[]byte("z"),
+			[]byte("x"),
+			true,
+			-1,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:2:3"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"missing key",
+			[]byte("other"),
+			[]byte("a"),
+			[]byte("x"),
+			true,
+			0,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:2:3"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+
+		var actualResult int64
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			var err error
+			actualResult, err = listInsert(txn, testCase.key, testCase.pivot, testCase.value, testCase.before)
+			return err
+		})
+
+		actualDataset := listDataset(t)
+		if actualResult != testCase.result || actualErr != testCase.err || !reflect.DeepEqual(actualDataset, testCase.dataset) {
+			t.Fatalf("Case \"%s\":\n Expected result=%v, err=%v, dataset=%q\nActual result=%v, err=%v, dataset=%q", testCase.title, testCase.result, testCase.err, testCase.dataset, actualResult, actualErr, actualDataset)
+		}
+	}
+}
+
+func TestListRemove(t *testing.T) {
+	testCases := []struct {
+		title   string
+		list    [][]byte
+		value   []byte
+		count   int64
+		result  int64
+		err     error
+		dataset [][]byte
+	}{
+		{
+			"every occurrence",
+			[][]byte{[]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a")},
+			[]byte("a"),
+			0,
+			3,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:1:2"),
+				listItemKey([]byte("key"), 0), []byte("b"),
+				listItemKey([]byte("key"), 1), []byte("c"),
+			},
+		},
+		{
+			"from the head",
+			[][]byte{[]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a")},
+			[]byte("a"),
+			2,
+			2,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:2:4:3"),
+				listItemKey([]byte("key"), 2), []byte("b"),
+				listItemKey([]byte("key"), 3), []byte("c"),
+				listItemKey([]byte("key"), 4), []byte("a"),
+			},
+		},
+		{
+			"from the tail",
+			[][]byte{[]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a")},
+			[]byte("a"),
+			-1,
+			1,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:3:4"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("a"),
+				listItemKey([]byte("key"), 3), []byte("c"),
+			},
+		},
+		{
+			"no occurrence",
+			[][]byte{[]byte("a"), []byte("b")},
+			[]byte("z"),
+			0,
+			0,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:1:2"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+			},
+		},
+		{
+			"every element",
+			[][]byte{[]byte("a"), []byte("a")},
+			[]byte("a"),
+			0,
+			2,
+			nil,
+			[][]byte{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), testCase.list)
+
+		var actualResult int64
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			var err error
+			actualResult, err = listRemove(txn, []byte("key"), testCase.value, testCase.count)
+			return err
+		})
+
+		actualDataset := listDataset(t)
+		if actualResult != testCase.result || actualErr != testCase.err || !reflect.DeepEqual(actualDataset, testCase.dataset) {
+			t.Fatalf("Case \"%s\":\n Expected result=%v, err=%v, dataset=%q\nActual result=%v, err=%v, dataset=%q", testCase.title, testCase.result, testCase.err, testCase.dataset, actualResult, actualErr, actualDataset)
+		}
+	}
+}
+
+func TestListTrim(t *testing.T) {
+	testCases := []struct {
+		title   string
+		start   int64
+		end     int64
+		err     error
+		dataset [][]byte
+	}{
+		{
+			"middle",
+			1,
+			2,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:1:2:2"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"negative offsets",
+			-1,
+			-1,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:3:3:1"),
+				listItemKey([]byte("key"), 3), []byte("d"),
+			},
+		},
+		{
+			"end past the tail",
+			0,
+			100,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:3:4"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+				listItemKey([]byte("key"), 3), []byte("d"),
+			},
+		},
+		{
+			"start after end",
+			2,
+			1,
+			nil,
+			[][]byte{},
+		},
+		{
+			"start past the tail",
+			10,
+			20,
+			nil,
+			[][]byte{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			return listTrim(txn, []byte("key"), testCase.start, testCase.end)
+		})
+
+		actualDataset := listDataset(t)
+		if actualErr != testCase.err || !reflect.DeepEqual(actualDataset, testCase.dataset) {
+			t.Fatalf("Case \"%s\":\n Expected err=%v, dataset=%q\nActual err=%v, dataset=%q", testCase.title, testCase.err, testCase.dataset, actualErr, actualDataset)
+		}
+	}
+}
+
+// TestListTooManyWrites trims and removes more elements than a transaction can hold, with
+// a memtable small enough for a transaction to hold about 1600 writes
+func TestListTooManyWrites(t *testing.T) {
+	inMemoryDB := db
+	defer func() { db = inMemoryDB }()
+	var err error
+	db, err = openStorage(StorageOptions{InMemory: true, MemTableSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := newClient(nil)
+	push := "RPUSH key" + strings.Repeat(" x", 500)
+	for i := 0; i < 6; i++ {
+		_, err = dispatchFields(c, push)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		title   string
+		command string
+		err     error
+		length  int64
+	}{
+		{"trim", "LTRIM key 0 0", ErrTooManyWrites, 3000},
+		{"remove", "LREM key 0 x", ErrTooManyWrites, 3000},
+		{"remove from the tail", "LREM key -2000 x", ErrTooManyWrites, 3000},
+		{"trim in a transaction", "MULTI\nLTRIM key 0 0\nEXEC", ErrTooManyWrites, 3000},
+		{"smaller trim", "LTRIM key 0 1999", nil, 2000},
+		{"smaller remove", "LREM key 1000 x", nil, 1000},
+	}
+	for _, testCase := range testCases {
+		for _, command := range strings.Split(testCase.command, "\n") {
+			_, err = dispatchFields(c, command)
+		}
+		// every element is still there, not only the metadata
+		elements, rangeErr := dispatchFields(c, "LRANGE key 0 -1")
+		length := int64(len(elements.([][]byte)))
+		if err != testCase.err || rangeErr != nil || length != testCase.length {
+			t.Fatalf("Case \"%s\":\n Expected err=%v, length=%d\n Actual err=%v, length=%d, %v", testCase.title, testCase.err, testCase.length, err, length, rangeErr)
+		}
+	}
+}
+
+func TestListMove(t *testing.T) {
+	testCases := []struct {
+		title       string
+		source      []byte
+		destination []byte
+		from        Direction
+		to          Direction
+		result      []byte
+		err         error
+		dataset     [][]byte
+	}{
+		{
+			"to another list",
+			[]byte("key"),
+			[]byte("other"),
+			DirectionRight,
+			DirectionLeft,
+			[]byte("c"),
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:1:2"),
+				[]byte("$$$_other"), []byte("L1:0:0:1"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("other"), 0), []byte("c"),
+			},
+		},
+		{
+			"rotation",
+			[]byte("key"),
+			[]byte("key"),
+			DirectionLeft,
+			DirectionRight,
+			[]byte("a"),
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:1:3:3"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+				listItemKey([]byte("key"), 3), []byte("a"),
+			},
+		},
+		{
+			"empty source",
+			[]byte("other"),
+			[]byte("key"),
+			DirectionLeft,
+			DirectionRight,
+			nil,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:2:3"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"destination is not a list",
+			[]byte("key"),
+			[]byte("name"),
+			DirectionLeft,
+			DirectionRight,
+			nil,
+			ErrWrongType,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:2:3"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+				[]byte("name"), []byte("value"),
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		if testCase.err != nil {
+			err := db.Update(func(txn *badger.Txn) error {
+				return stringSet(txn, []byte("name"), []byte("value"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var actualResult []byte
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			var err error
+			actualResult, _, err = listMove(txn, testCase.source, testCase.destination, testCase.from, testCase.to)
+			return err
+		})
+
+		actualDataset := listDataset(t)
+		if !reflect.DeepEqual(actualResult, testCase.result) || actualErr != testCase.err || !reflect.DeepEqual(actualDataset, testCase.dataset) {
+			t.Fatalf("Case \"%s\":\n Expected result=%q, err=%v, dataset=%q\nActual result=%q, err=%v, dataset=%q", testCase.title, testCase.result, testCase.err, testCase.dataset, actualResult, actualErr, actualDataset)
+		}
+	}
+}
+
+func TestListPopCount(t *testing.T) {
+	testCases := []struct {
+		title     string
+		key       []byte
+		direction Direction
+		count     int64
+		result    [][]byte
+		dataset   [][]byte
+	}{
+		{
+			"from the head",
+			[]byte("key"),
+			DirectionLeft,
+			2,
+			[][]byte{[]byte("a"), []byte("b")},
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:2:2:1"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+		{
+			"from the tail",
+			[]byte("key"),
+			DirectionRight,
+			2,
+			[][]byte{[]byte("c"), []byte("b")},
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:0:1"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+			},
+		},
+		{
+			"count over the size",
+			[]byte("key"),
+			DirectionLeft,
+			10,
+			[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+			[][]byte{},
+		},
+		{
+			"missing list",
+			[]byte("missing"),
+			DirectionLeft,
+			2,
+			nil,
+			[][]byte{
+				[]byte("$$$_key"), []byte("L1:0:2:3"),
+				listItemKey([]byte("key"), 0), []byte("a"),
+				listItemKey([]byte("key"), 1), []byte("b"),
+				listItemKey([]byte("key"), 2), []byte("c"),
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+
+		var actualResult [][]byte
+		actualErr := db.Update(func(txn *badger.Txn) error {
+			var err error
+			actualResult, err = listPopCount(txn, testCase.key, testCase.direction, testCase.count)
+			return err
+		})
+
+		actualDataset := listDataset(t)
+		if !reflect.DeepEqual(actualResult, testCase.result) || actualErr != nil || !reflect.DeepEqual(actualDataset, testCase.dataset) {
+			t.Fatalf("Case \"%s\":\n Expected result=%q, dataset=%q\nActual result=%q, err=%v, dataset=%q", testCase.title, testCase.result, testCase.dataset, actualResult, actualErr, actualDataset)
+		}
+	}
+}
+
+func TestListPositions(t *testing.T) {
+	testCases := []struct {
+		title  string
+		value  []byte
+		rank   int64
+		count  int64
+		maxLen int64
+		result []int64
+	}{
+		{"first match", []byte("a"), 1, 1, 0, []int64{0}},
+		{"second match", []byte("a"), 2, 1, 0, []int64{2}},
+		{"every match", []byte("a"), 1, 0, 0, []int64{0, 2, 4}},
+		{"from the tail", []byte("a"), -1, 2, 0, []int64{4, 2}},
+		{"rank past the matches", []byte("a"), 4, 0, 0, []int64{}},
+		{"max length", []byte("a"), 1, 0, 3, []int64{0, 2}},
+		{"no match", []byte("z"), 1, 0, 0, []int64{}},
+	}
+
+	createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a")})
+	for _, testCase := range testCases {
+		var actualResult []int64
+		actualErr := db.View(func(txn *badger.Txn) error {
+			var err error
+			actualResult, err = listPositions(txn, []byte("key"), testCase.value, testCase.rank, testCase.count, testCase.maxLen)
+			return err
+		})
+
+		if !reflect.DeepEqual(actualResult, testCase.result) || actualErr != nil {
+			t.Fatalf("Case \"%s\":\n Expected result=%v\nActual result=%v, err=%v", testCase.title, testCase.result, actualResult, actualErr)
+		}
+	}
+}
+
+// TestListNameCollision pushes to a list named like an element key of another one, the
+// metadata key of each list must not be the element key of the other
+func TestListNameCollision(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("k")
+	itemKey := listItemKey(key, 0)
+	other := append([]byte("k:"), itemKey[len(itemKey)-listIndexLen:]...)
+
+	c := newClient(nil)
+	for _, args := range [][][]byte{
+		{[]byte("RPUSH"), other, []byte("x")},
+		{[]byte("RPUSH"), key, []byte("a"), []byte("b")},
+	} {
+		_, err = dispatch(c, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, list := range []struct {
+		key    []byte
+		values [][]byte
+	}{
+		{key, [][]byte{[]byte("a"), []byte("b")}},
+		{other, [][]byte{[]byte("x")}},
+	} {
+		values, err := dispatch(c, [][]byte{[]byte("LRANGE"), list.key, []byte("0"), []byte("-1")})
+		if err != nil || !reflect.DeepEqual(values, list.values) {
+			t.Fatalf("Case %q:\n Expected values=%q\n Actual values=%q, err=%v", list.key, list.values, values, err)
+		}
+	}
+}
+
+func TestListMetadata(t *testing.T) {
+	testCases := []struct {
+		title    string
+		data     []byte
+		metadata interface{}
+		err      error
+		encoded  string
+	}{
+		{"unversioned", []byte("L:0:0:1"), ListMetadata{0, 0, 1, false}, nil, "L1:0:0:1"},
+		{"versioned", []byte("L1:-1:2:4"), ListMetadata{-1, 2, 4, false}, nil, "L1:-1:2:4"},
+		{"64 bit size", []byte("L1:0:1ffffffff:200000000"), ListMetadata{0, 0x1ffffffff, 0x200000000, false}, nil, "L1:0:1ffffffff:200000000"},
+		{"quicklist", []byte("Q1:-1:1:3"), ListMetadata{-1, 1, 3, true}, nil, "Q1:-1:1:3"},
+		{"quicklist with chunk counts", []byte("Q1:0:1:3:2,1"), nil, ErrInvalidListMetadata, ""},
+		{"unversioned quicklist", []byte("Q:0:0:1"), nil, ErrInvalidListMetadata, ""},
+		{"quicklist missing a field", []byte("Q1:0:1"), nil, ErrInvalidListMetadata, ""},
+		{"size not matching the indexes", []byte("L1:0:1:3"), nil, ErrInvalidListMetadata, ""},
+		{"quicklist size not matching the indexes", []byte("Q1:0:0:2"), nil, ErrInvalidListMetadata, ""},
+		{"unsupported version", []byte("L2:0:0:1"), nil, ErrUnsupportedListMetadata, ""},
+		{"negative size", []byte("L1:0:0:-1"), nil, ErrInvalidListMetadata, ""},
+	}
+
+	for _, testCase := range testCases {
+		metadata, err := UnmarshalListMetadata(testCase.data)
+		encoded := ""
+		if err == nil {
+			encoded = metadata.(ListMetadata).String()
+		}
+		if !reflect.DeepEqual(metadata, testCase.metadata) || err != testCase.err || encoded != testCase.encoded {
+			t.Fatalf("Case \"%s\":\n Expected metadata=%v, err=%v, encoded=%s\nActual metadata=%v, err=%v, encoded=%s", testCase.title, testCase.metadata, testCase.err, testCase.encoded, metadata, err, encoded)
+		}
+	}
+}
+
+func TestListCorruptMetadata(t *testing.T) {
+	testCases := []struct {
+		title    string
+		metadata string
+		items    [][]byte
+	}{
+		{"unversioned quicklist", "Q:0:0:1", nil},
+		{"quicklist without chunks", "Q1:0:0:1", nil},
+		{"empty chunk", "Q1:0:1:2", [][]byte{{}}},
+		{"chunk shorter than the list", "Q1:0:1:2", [][]byte{encodeChunk([][]byte{[]byte("a")})}},
+		{"invalid chunk", "Q1:0:1:2", [][]byte{[]byte("\x05a")}},
+		{"list without elements", "L1:0:1:2", nil},
+	}
+	commands := []string{"LLEN x", "LRANGE x 0 -1", "LINDEX x 1", "LSET x 1 v", "LINSERT x BEFORE a v", "LREM x 0 a", "LTRIM x 1 1", "LPOS x a", "RPUSH x v", "LPUSH x v", "RPOP x", "LPOP x"}
+
+	c := newClient(nil)
+	for _, testCase := range testCases {
+		for _, command := range commands {
+			err := db.DropAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Update(func(txn *badger.Txn) error {
+				for i, item := range testCase.items {
+					err := txn.Set(listItemKey([]byte("x"), int64(i)), item)
+					if err != nil {
+						return err
+					}
+				}
+				return txn.Set([]byte("$$$_x"), []byte(testCase.metadata))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("Case \"%s\":\n Expected no panic from %s\n Actual %v", testCase.title, command, r)
+					}
+				}()
+				dispatchFields(c, command)
+			}()
+		}
+	}
+}
+
+func TestListOverflow(t *testing.T) {
+	push := func(direction Direction) func(txn *badger.Txn) error {
+		return func(txn *badger.Txn) error {
+			_, err := listPush(txn, []byte("key"), [][]byte{[]byte("x")}, direction)
+			return err
+		}
+	}
+	insert := func(txn *badger.Txn) error {
+		_, err := listInsert(txn, []byte("key"), []byte("b"), []byte("x"), true)
+		return err
+	}
+
+	testCases := []struct {
+		title    string
+		metadata string
+		items    [][]byte
+		op       func(txn *badger.Txn) error
+		err      error
+		result   string
+	}{
+		{
+			"push before the lowest index",
+			"L1:-8000000000000000:-7fffffffffffffff:2",
+			[][]byte{[]byte("a"), []byte("b")},
+			push(DirectionLeft),
+			ErrListIndexOverflow,
+			"L1:-8000000000000000:-7fffffffffffffff:2",
+		},
+		{
+			"push at the other end",
+			"L1:-8000000000000000:-7fffffffffffffff:2",
+			[][]byte{[]byte("a"), []byte("b")},
+			push(DirectionRight),
+			nil,
+			"L1:-8000000000000000:-7ffffffffffffffe:3",
+		},
+		{
+			"push after the highest index",
+			"L1:7ffffffffffffffe:7fffffffffffffff:2",
+			[][]byte{[]byte("a"), []byte("b")},
+			push(DirectionRight),
+			ErrListIndexOverflow,
+			"L1:7ffffffffffffffe:7fffffffffffffff:2",
+		},
+		{
+			"insert moving elements past the highest index",
+			"L1:7ffffffffffffffe:7fffffffffffffff:2",
+			[][]byte{[]byte("a"), []byte("b")},
+			insert,
+			ErrListIndexOverflow,
+			"L1:7ffffffffffffffe:7fffffffffffffff:2",
+		},
+		{
+			"size at the limit",
+			"L1:-4000000000000000:3ffffffffffffffe:7fffffffffffffff",
+			[][]byte{[]byte("a"), []byte("b")},
+			push(DirectionLeft),
+			ErrListSizeOverflow,
+			"L1:-4000000000000000:3ffffffffffffffe:7fffffffffffffff",
+		},
+		{
+			"quicklist push after the highest index",
+			"Q1:7ffffffffffffffe:7fffffffffffffff:2",
+			[][]byte{encodeChunk([][]byte{[]byte("a"), []byte("b")})},
+			push(DirectionRight),
+			ErrListIndexOverflow,
+			"Q1:7ffffffffffffffe:7fffffffffffffff:2",
+		},
+	}
+
+	for _, testCase := range testCases {
+		err := db.DropAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			metadata, err := UnmarshalListMetadata([]byte(testCase.metadata))
+			if err != nil {
+				return err
+			}
+			for i, item := range testCase.items {
+				err := txn.Set(listItemKey([]byte("key"), metadata.(ListMetadata).first+int64(i)), item)
+				if err != nil {
+					return err
+				}
+			}
+			return txn.Set([]byte("$$$_key"), []byte(testCase.metadata))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actualErr := db.Update(testCase.op)
+		actualResult := ""
+		err = db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("$$$_key"))
+			if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			actualResult = string(value)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actualErr != testCase.err || actualResult != testCase.result {
+			t.Fatalf("Case \"%s\":\n Expected err=%v, metadata=%s\nActual err=%v, metadata=%s", testCase.title, testCase.err, testCase.result, actualErr, actualResult)
+		}
+	}
+}
+
+// quicklistChunkCounts returns the number of elements of each chunk of the quicklist at
+// key, from the head. It fails unless the chunks start at the first element of the list
+// and each one starts right after the previous one.
+func quicklistChunkCounts(txn *badger.Txn, key []byte) ([]uint32, error) {
+	metadata, _, err := listGetMetadata(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	counts := []uint32{}
+	next := metadata.first
+	err = listWalk(txn, key, metadata.first, metadata.last, false, func(start int64, chunk []byte) (bool, error) {
+		elements, err := decodeChunk(chunk)
+		if err != nil {
+			return false, err
+		}
+		if start != next {
+			return false, fmt.Errorf("chunk starts at %d instead of %d", start, next)
+		}
+		next += int64(len(elements))
+		counts = append(counts, uint32(len(elements)))
+		return true, nil
+	})
+	if err == nil && next != metadata.last+1 {
+		err = fmt.Errorf("chunks end at %d instead of %d", next-1, metadata.last)
+	}
+	return counts, err
+}
+
+func TestQuicklist(t *testing.T) {
+	// every element takes 2 bytes, so chunks hold 2 elements
+	setListEncoding(listEncodingQuicklist, 4)
+	defer setListEncoding(listEncodingLinkedList, 8*1024)
+
+	testCases := []struct {
+		title    string
+		update   func(txn *badger.Txn) error
+		elements [][]byte
+		chunks   []uint32
+	}{
+		{
+			"create",
+			func(txn *badger.Txn) error { return nil },
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{2, 2, 1},
+		},
+		{
+			"push to the head",
+			func(txn *badger.Txn) error {
+				_, err := listPush(txn, []byte("key"), [][]byte{[]byte("x"), []byte("y"), []byte("z")}, DirectionLeft)
+				return err
+			},
+			[][]byte{[]byte("x"), []byte("y"), []byte("z"), []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{1, 2, 2, 2, 1},
+		},
+		{
+			"push to the tail",
+			func(txn *badger.Txn) error {
+				_, err := listPush(txn, []byte("key"), [][]byte{[]byte("x"), []byte("y")}, DirectionRight)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"), []byte("x"), []byte("y")},
+			[]uint32{2, 2, 2, 1},
+		},
+		{
+			"pop across chunks",
+			func(txn *badger.Txn) error {
+				_, err := listPopCount(txn, []byte("key"), DirectionLeft, 3)
+				return err
+			},
+			[][]byte{[]byte("d"), []byte("e")},
+			[]uint32{1, 1},
+		},
+		{
+			"set",
+			func(txn *badger.Txn) error { return listSet(txn, []byte("key"), []byte("x"), -3) },
+			[][]byte{[]byte("a"), []byte("b"), []byte("x"), []byte("d"), []byte("e")},
+			[]uint32{2, 2, 1},
+		},
+		{
+			"set splitting a chunk",
+			func(txn *badger.Txn) error { return listSet(txn, []byte("key"), []byte("xyz"), 1) },
+			[][]byte{[]byte("a"), []byte("xyz"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{1, 1, 2, 1},
+		},
+		{
+			"set in a chunk of one element",
+			func(txn *badger.Txn) error { return listSet(txn, []byte("key"), []byte("xyz"), -1) },
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("xyz")},
+			[]uint32{2, 2, 1},
+		},
+		{
+			"insert splitting a chunk",
+			func(txn *badger.Txn) error {
+				_, err := listInsert(txn, []byte("key"), []byte("c"), []byte("x"), true)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("x"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{2, 1, 2, 1},
+		},
+		{
+			"insert in a chunk with room",
+			func(txn *badger.Txn) error {
+				_, err := listInsert(txn, []byte("key"), []byte("e"), []byte("x"), false)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"), []byte("x")},
+			[]uint32{2, 2, 2},
+		},
+		{
+			"remove",
+			func(txn *badger.Txn) error {
+				_, err := listRemove(txn, []byte("key"), []byte("b"), 0)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{1, 2, 1},
+		},
+		{
+			"remove emptying a chunk",
+			func(txn *badger.Txn) error {
+				_, err := listRemove(txn, []byte("key"), []byte("e"), -1)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")},
+			[]uint32{2, 2},
+		},
+		{
+			"remove emptying a middle chunk",
+			func(txn *badger.Txn) error {
+				err := listSet(txn, []byte("key"), []byte("c"), 3)
+				if err != nil {
+					return err
+				}
+				_, err = listRemove(txn, []byte("key"), []byte("c"), 0)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("e")},
+			[]uint32{2, 1},
+		},
+		{
+			"remove from the head up to count",
+			func(txn *badger.Txn) error {
+				_, err := listPush(txn, []byte("key"), [][]byte{[]byte("c")}, DirectionLeft)
+				if err != nil {
+					return err
+				}
+				_, err = listRemove(txn, []byte("key"), []byte("c"), 1)
+				return err
+			},
+			[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")},
+			[]uint32{2, 2, 1},
+		},
+		{
+			"trim",
+			func(txn *badger.Txn) error { return listTrim(txn, []byte("key"), 1, 3) },
+			[][]byte{[]byte("b"), []byte("c"), []byte("d")},
+			[]uint32{1, 2},
+		},
+		{
+			"trim inside a chunk",
+			func(txn *badger.Txn) error { return listTrim(txn, []byte("key"), 2, 2) },
+			[][]byte{[]byte("c")},
+			[]uint32{1},
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")})
+		err := db.Update(testCase.update)
+		if err != nil {
+			t.Fatalf("Case \"%s\":\n Unexpected error %v", testCase.title, err)
+		}
+
+		var elements [][]byte
+		var chunks []uint32
+		err = db.View(func(txn *badger.Txn) error {
+			var err error
+			elements, err = listRange(txn, []byte("key"), 0, -1)
+			if err != nil {
+				return err
+			}
+			chunks, err = quicklistChunkCounts(txn, []byte("key"))
+			return err
+		})
+		if err != nil || !reflect.DeepEqual(elements, testCase.elements) || !reflect.DeepEqual(chunks, testCase.chunks) {
+			t.Fatalf("Case \"%s\":\n Expected elements=%q, chunks=%v\n Actual elements=%q, chunks=%v, err=%v", testCase.title, testCase.elements, testCase.chunks, elements, chunks, err)
+		}
+	}
+}
+
+func TestQuicklistSplit(t *testing.T) {
+	// one byte elements take 2 bytes, so a chunk holds 4 of them
+	setListEncoding(listEncodingQuicklist, 8)
+	defer setListEncoding(listEncodingLinkedList, 8*1024)
+	createTestList(t, []byte("key"), [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+
+	// the chunk takes 14 bytes once "vwxyz" is inserted, its second half 10
+	err := db.Update(func(txn *badger.Txn) error {
+		_, err := listInsert(txn, []byte("key"), []byte("d"), []byte("vwxyz"), true)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var elements [][]byte
+	var chunkSizes []int
+	err = db.View(func(txn *badger.Txn) error {
+		var err error
+		elements, err = listRange(txn, []byte("key"), 0, -1)
+		if err != nil {
+			return err
+		}
+		metadata, _, err := listGetMetadata(txn, []byte("key"))
+		if err != nil {
+			return err
+		}
+		return listWalk(txn, []byte("key"), metadata.first, metadata.last, false, func(start int64, chunk []byte) (bool, error) {
+			chunkSizes = append(chunkSizes, len(chunk))
+			return true, nil
+		})
+	})
+	expectedElements := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("vwxyz"), []byte("d")}
+	expectedSizes := []int{4, 2, 8}
+	if err != nil || !reflect.DeepEqual(elements, expectedElements) || !reflect.DeepEqual(chunkSizes, expectedSizes) {
+		t.Fatalf("Expected elements=%q, chunk sizes=%v\n Actual elements=%q, chunk sizes=%v, err=%v", expectedElements, expectedSizes, elements, chunkSizes, err)
+	}
+}
+
+// benchmarkEncodings runs benchmark once per list encoding, on an empty database
+func benchmarkEncodings(b *testing.B, benchmark func(b *testing.B)) {
+	defer setListEncoding(listEncodingLinkedList, 8*1024)
+	for _, encoding := range []string{listEncodingLinkedList, listEncodingQuicklist} {
+		setListEncoding(encoding, 8*1024)
+		b.Run(encoding, func(b *testing.B) {
+			err := db.DropAll()
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchmark(b)
+		})
+	}
+}
+
+func BenchmarkListPush(b *testing.B) {
+	benchmarkEncodings(b, func(b *testing.B) {
+		values := [][]byte{[]byte("element")}
+		for i := 0; i < b.N; i++ {
+			err := db.Update(func(txn *badger.Txn) error {
+				_, err := listPush(txn, []byte("key"), values, DirectionRight)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkListRange(b *testing.B) {
+	benchmarkEncodings(b, func(b *testing.B) {
+		values := make([][]byte, 10000)
+		for i := range values {
+			values[i] = []byte("element")
+		}
+		err := db.Update(func(txn *badger.Txn) error {
+			_, err := listPush(txn, []byte("key"), values, DirectionRight)
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err := db.View(func(txn *badger.Txn) error {
+				_, err := listRange(txn, []byte("key"), 0, -1)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
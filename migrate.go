@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	badger "github.com/dgraph-io/badger/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// storageVersionKey holds the version of the storage layout, databases written before
+// it existed are at version 0
+const storageVersionKey = "$$$version"
+
+// storageVersion is the current storage layout. Version 1 stores the index of list
+// elements in binary, it was a hex string before. Version 2 moves the element keys from
+// internalKeyPrefix, where the element key of a list could be the metadata key of
+// another one, to listItemKeyPrefix.
+const storageVersion = 2
+
+// storedList is a list found by migrateStorage whose elements may still use the keys of
+// an older layout
+type storedList struct {
+	key      []byte
+	metadata ListMetadata
+}
+
+// migrateStorage upgrades a database written by an older version to the current layout,
+// it returns how many lists were migrated. It is run once at startup before clients
+// connect, and can be run again if it was interrupted.
+func migrateStorage(db *badger.DB) (int, error) {
+	version := 0
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(storageVersionKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		version, err = strconv.Atoi(string(value))
+		return err
+	})
+	if err != nil || version >= storageVersion {
+		return 0, err
+	}
+
+	// the hex lists are moved to the current layout right away, the binary keys of
+	// version 1 are only looked for in databases which were at version 1
+	isElement, migrateList := isHexListElement, migrateHexList
+	if version == 1 {
+		isElement, migrateList = isBinaryListElement, migrateBinaryList
+	}
+	lists, err := findLists(db, version == 0, isElement)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, list := range lists {
+		moved, err := migrateList(db, list)
+		if err != nil {
+			return migrated, err
+		}
+		if moved {
+			migrated++
+		}
+	}
+
+	return migrated, db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(storageVersionKey), []byte(strconv.Itoa(storageVersion)))
+	})
+}
+
+// findLists returns the list metadata entries of the database. In the older layouts the
+// element at index i of the list at key is stored under key:i, next to the metadata of a
+// list which could be named that way. Small values which parse as list metadata are
+// read first, then the ones whose key isElement finds to be the key of an element of
+// another list are dropped, so the elements which happen to hold list metadata are not
+// taken for lists. Lists with hex keys were written before list metadata had a version,
+// unversioned only keeps the metadata without one.
+func findLists(db *badger.DB, unversioned bool, isElement func(key string, lists map[string]ListMetadata) bool) ([]storedList, error) {
+	candidates := map[string]ListMetadata{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(internalKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.ValidForPrefix(opts.Prefix); it.Next() {
+			item := it.Item()
+			if item.ValueSize() > 64 {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if unversioned && !bytes.HasPrefix(value, []byte{internalListType, ':'}) {
+				continue
+			}
+			metadata, err := UnmarshalListMetadata(value)
+			if err != nil {
+				continue
+			}
+			key := item.Key()[len(internalKeyPrefix):]
+			candidates[string(key)] = metadata.(ListMetadata)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lists := []storedList{}
+	for key, metadata := range candidates {
+		if !isElement(key, candidates) {
+			lists = append(lists, storedList{[]byte(key), metadata})
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return bytes.Compare(lists[i].key, lists[j].key) < 0 })
+	return lists, nil
+}
+
+// isHexListElement tells whether key has the shape of a hex element key, list:index,
+// for one of lists whose indexes include it
+func isHexListElement(key string, lists map[string]ListMetadata) bool {
+	separator := strings.LastIndexByte(key, ':')
+	if separator < 0 {
+		return false
+	}
+	suffix := key[separator+1:]
+	index, err := strconv.ParseInt(suffix, 16, 64)
+	// indexes were written the way FormatInt writes them
+	if err != nil || strconv.FormatInt(index, 16) != suffix {
+		return false
+	}
+	metadata, ok := lists[key[:separator]]
+	return ok && index >= metadata.first && index <= metadata.last
+}
+
+// isBinaryListElement is isHexListElement for the binary element keys of version 1,
+// list:index with the index as written by listItemKey
+func isBinaryListElement(key string, lists map[string]ListMetadata) bool {
+	separator := len(key) - listIndexLen - 1
+	if separator < 0 || key[separator] != ':' {
+		return false
+	}
+	index := int64(binary.BigEndian.Uint64([]byte(key[separator+1:])) ^ (1 << 63))
+	metadata, ok := lists[key[:separator]]
+	return ok && index >= metadata.first && index <= metadata.last
+}
+
+// migrateHexList moves the elements of a list from their hex keys to listItemKey. The
+// writes are batched as a list can be too big for a single transaction, elements
+// already moved by an interrupted migration are skipped.
+func migrateHexList(db *badger.DB, list storedList) (bool, error) {
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+
+	moved := false
+	err := db.View(func(txn *badger.Txn) error {
+		hexPrefix := append([]byte(internalKeyPrefix), list.key...)
+		hexPrefix = append(hexPrefix, ':')
+		for index := list.metadata.first; index <= list.metadata.last; index++ {
+			hexKey := append(append([]byte{}, hexPrefix...), strconv.FormatInt(index, 16)...)
+			item, err := txn.Get(hexKey)
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = batch.Set(listItemKey(list.key, index), value)
+			if err != nil {
+				return err
+			}
+			err = batch.Delete(hexKey)
+			if err != nil {
+				return err
+			}
+			moved = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return moved, batch.Flush()
+}
+
+// migrateBinaryList moves the elements, or the chunks, of a list from their version 1
+// keys under internalKeyPrefix to listItemKey, batched like migrateHexList
+func migrateBinaryList(db *badger.DB, list storedList) (bool, error) {
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+
+	moved := false
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := append([]byte(internalKeyPrefix), list.key...)
+		prefix = append(prefix, ':')
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			oldKey := item.KeyCopy(nil)
+			if len(oldKey) != len(prefix)+listIndexLen {
+				// the metadata or an element of another list whose name starts with
+				// this one and a colon
+				continue
+			}
+			index := int64(binary.BigEndian.Uint64(oldKey[len(prefix):]) ^ (1 << 63))
+			if index < list.metadata.first || index > list.metadata.last {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = batch.Set(listItemKey(list.key, index), value)
+			if err != nil {
+				return err
+			}
+			err = batch.Delete(oldKey)
+			if err != nil {
+				return err
+			}
+			moved = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return moved, batch.Flush()
+}
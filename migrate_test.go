@@ -0,0 +1,168 @@
+package main
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lists written with hex element keys, "other" was partly migrated already and the
+	// element at index 3 of "key" holds what looks like list metadata
+	hexDataset := [][]byte{
+		[]byte("$$$_key"), []byte("L:-2:a:d"),
+		[]byte("$$$_other"), []byte("L:0:1:2"),
+		[]byte("$$$_other:1"), []byte("y"),
+		[]byte("$$$_user:ff"), []byte("L:0:0:1"),
+		[]byte("$$$_user:ff:0"), []byte("z"),
+		[]byte("name"), []byte("L:0:0:1"),
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < len(hexDataset); i += 2 {
+			err := txn.Set(hexDataset[i], hexDataset[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		for index := int64(-2); index <= 10; index++ {
+			hexKey := append([]byte("$$$_key:"), strconv.FormatInt(index, 16)...)
+			value := []byte{byte('a' + index + 2)}
+			if index == 3 {
+				value = []byte("L:0:0:1")
+			}
+			err := txn.Set(hexKey, value)
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Set(listItemKey([]byte("other"), 0), []byte("x"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lists, err := findLists(db, true, isHexListElement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, list := range lists {
+		keys = append(keys, string(list.key))
+	}
+	if !reflect.DeepEqual(keys, []string{"key", "other", "user:ff"}) {
+		t.Fatalf("Expected lists=%q\n Actual lists=%q", []string{"key", "other", "user:ff"}, keys)
+	}
+
+	testCases := []struct {
+		title    string
+		migrated int
+	}{
+		{"hex keys", 3},
+		{"already migrated", 0},
+	}
+	for _, testCase := range testCases {
+		migrated, err := migrateStorage(db)
+		if err != nil || migrated != testCase.migrated {
+			t.Fatalf("Case \"%s\":\n Expected migrated=%d\n Actual migrated=%d, err=%v", testCase.title, testCase.migrated, migrated, err)
+		}
+	}
+
+	migratedLists := []struct {
+		key    []byte
+		size   int64
+		values [][]byte
+	}{
+		{[]byte("key"), 13, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"), []byte("L:0:0:1"), []byte("g"), []byte("h"), []byte("i"), []byte("j"), []byte("k"), []byte("l"), []byte("m")}},
+		{[]byte("other"), 2, [][]byte{[]byte("x"), []byte("y")}},
+		{[]byte("user:ff"), 1, [][]byte{[]byte("z")}},
+	}
+	for _, list := range migratedLists {
+		var values [][]byte
+		var size int64
+		err := db.View(func(txn *badger.Txn) error {
+			length, err := listLength(txn, list.key)
+			if err != nil {
+				return err
+			}
+			size = length
+			values, err = listRange(txn, list.key, 0, -1)
+			return err
+		})
+		if err != nil || size != list.size || !reflect.DeepEqual(values, list.values) {
+			t.Fatalf("Case \"%s\":\n Expected size=%d, values=%q\n Actual size=%d, values=%q, err=%v", list.key, list.size, list.values, size, values, err)
+		}
+	}
+}
+
+func TestMigrateBinaryKeys(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 1 element keys sit next to the metadata, "key:<index 5>" is a list and the
+	// element at index 1 of "key" holds what looks like list metadata
+	v1ItemKey := func(key []byte, index int64) []byte {
+		itemKey := listItemKey(key, index)
+		return append(append([]byte(internalKeyPrefix), key...), itemKey[len(itemKey)-listIndexLen-1:]...)
+	}
+	key := []byte("key")
+	other := v1ItemKey(key, 5)[len(internalKeyPrefix):]
+	v1Dataset := [][]byte{
+		[]byte(storageVersionKey), []byte("1"),
+		[]byte("$$$_key"), []byte("L1:0:1:2"),
+		v1ItemKey(key, 0), []byte("a"),
+		v1ItemKey(key, 1), []byte("L1:0:0:1"),
+		append([]byte(internalKeyPrefix), other...), []byte("L1:0:0:1"),
+		v1ItemKey(other, 0), []byte("z"),
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < len(v1Dataset); i += 2 {
+			err := txn.Set(v1Dataset[i], v1Dataset[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		title    string
+		migrated int
+	}{
+		{"binary keys", 2},
+		{"already migrated", 0},
+	}
+	for _, testCase := range testCases {
+		migrated, err := migrateStorage(db)
+		if err != nil || migrated != testCase.migrated {
+			t.Fatalf("Case \"%s\":\n Expected migrated=%d\n Actual migrated=%d, err=%v", testCase.title, testCase.migrated, migrated, err)
+		}
+	}
+
+	lists := []struct {
+		key    []byte
+		values [][]byte
+	}{
+		{key, [][]byte{[]byte("a"), []byte("L1:0:0:1")}},
+		{other, [][]byte{[]byte("z")}},
+	}
+	for _, list := range lists {
+		var values [][]byte
+		err := db.View(func(txn *badger.Txn) error {
+			var err error
+			values, err = listRange(txn, list.key, 0, -1)
+			return err
+		})
+		if err != nil || !reflect.DeepEqual(values, list.values) {
+			t.Fatalf("Case %q:\n Expected values=%q\n Actual values=%q, err=%v", list.key, list.values, values, err)
+		}
+	}
+}
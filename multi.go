@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	badger "github.com/dgraph-io/badger/v2"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrNestedMulti = errors.New("ERR MULTI calls can not be nested")
+var ErrExecWithoutMulti = errors.New("ERR EXEC without MULTI")
+var ErrDiscardWithoutMulti = errors.New("ERR DISCARD without MULTI")
+var ErrWatchInMulti = errors.New("ERR WATCH inside MULTI is not allowed")
+var ErrExecAbort = errors.New("EXECABORT Transaction discarded because of previous errors.")
+var ErrExecConflict = errors.New("ERR transaction conflicts with a concurrent write, its writes were discarded")
+var ErrTooManyWrites = errors.New("ERR too many keys written at once, the writes were discarded")
+
+// unqueuedCommands run right away even when the client is in a MULTI block
+var unqueuedCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"quit":    true,
+}
+
+// nonTransactionalCommands have effects outside of the badger transaction of EXEC, which
+// cannot be undone. A transaction queuing one of them is not run again when it conflicts
+// with a concurrent write, since their effects would be repeated.
+var nonTransactionalCommands = map[string]bool{
+	"hello":    true,
+	"auth":     true,
+	"acl":      true,
+	"client":   true,
+	"shutdown": true,
+	"seq":      true,
+	"publish":  true,
+}
+
+// update runs fn in the transaction of the EXEC the client is running, or else in a new
+// read-write transaction which is committed right away. The new transaction is retried
+// when it conflicts with a concurrent write, so fn may run more than once. A transaction
+// can only hold so many writes, about 15% of badger-memtable-size, going over fails with
+// ErrTooManyWrites and nothing is written.
+func update(c *client, fn func(txn *badger.Txn) error) error {
+	var err error
+	if c.txn != nil {
+		err = fn(c.txn)
+	} else {
+		err = retryConflicts(func() error {
+			return db.Update(fn)
+		})
+	}
+	if err == badger.ErrTxnTooBig {
+		return ErrTooManyWrites
+	}
+	return err
+}
+
+// view is like update for commands which only read
+func view(c *client, fn func(txn *badger.Txn) error) error {
+	if c.txn != nil {
+		return fn(c.txn)
+	}
+	return db.View(fn)
+}
+
+type queuedCommand struct {
+	cmd  command
+	args [][]byte
+}
+
+// multiState holds the commands a client queued since MULTI
+type multiState struct {
+	commands []queuedCommand
+	// failed is set when a command could not be queued, EXEC then discards the
+	// transaction
+	failed bool
+}
+
+// transactional tells whether the queued commands only act through the transaction of
+// EXEC, so they can be run again
+func (state *multiState) transactional() bool {
+	for _, queued := range state.commands {
+		if nonTransactionalCommands[queued.cmd.name] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchedKey is a key a client watches, with the versions of the key and of its list
+// metadata when WATCH was called, 0 for the ones which did not exist
+type watchedKey struct {
+	key      []byte
+	versions [2]uint64
+}
+
+// watchedVersions returns the versions of key and of its list metadata, every write to a
+// key or a list gives them a new version
+func watchedVersions(txn *badger.Txn, key []byte) ([2]uint64, error) {
+	versions := [2]uint64{}
+	for i, versioned := range [][]byte{key, append([]byte(internalKeyPrefix), key...)} {
+		item, err := txn.Get(versioned)
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return versions, err
+		}
+		versions[i] = item.Version()
+	}
+	return versions, nil
+}
+
+// watchedKeysChanged tells whether a key the client watches was written since WATCH,
+// as seen by txn. Reading the keys also makes the commit of txn fail if they are
+// written by another client in the meantime.
+func watchedKeysChanged(c *client, txn *badger.Txn) (bool, error) {
+	for _, watched := range c.watched {
+		versions, err := watchedVersions(txn, watched.key)
+		if err != nil {
+			return false, err
+		}
+		if versions != watched.versions {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// watchRegistry tracks which clients watch which keys. Writes touch their keys once
+// committed, which marks the clients watching a key whose versions changed since WATCH
+// as dirty so their EXEC fails, even if the key is back to not existing by then. Writes
+// which changed nothing, like LPUSHX on a missing key, leave the versions as they were.
+// A write which committed before the key was registered is caught by EXEC comparing the
+// versions of the watched keys.
+type watchRegistry struct {
+	mu   sync.Mutex
+	keys map[string]map[*client]struct{}
+	// dirty are the clients for which one of the watched keys was touched
+	dirty map[*client]bool
+}
+
+var watches = &watchRegistry{
+	keys:  map[string]map[*client]struct{}{},
+	dirty: map[*client]bool{},
+}
+
+func (w *watchRegistry) watch(c *client, key []byte, versions [2]uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clients, ok := w.keys[string(key)]
+	if !ok {
+		clients = map[*client]struct{}{}
+		w.keys[string(key)] = clients
+	}
+	if _, ok := clients[c]; ok {
+		return
+	}
+	clients[c] = struct{}{}
+	c.watched = append(c.watched, watchedKey{key, versions})
+}
+
+// unwatch forgets every key the client watches
+func (w *watchRegistry) unwatch(c *client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, watched := range c.watched {
+		clients := w.keys[string(watched.key)]
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(w.keys, string(watched.key))
+		}
+	}
+	c.watched = nil
+	delete(w.dirty, c)
+}
+
+func (w *watchRegistry) touch(keys [][]byte) {
+	w.mu.Lock()
+	watched := [][]byte{}
+	for _, key := range keys {
+		if len(w.keys[string(key)]) > 0 {
+			watched = append(watched, key)
+		}
+	}
+	w.mu.Unlock()
+	if len(watched) == 0 {
+		return
+	}
+
+	current := map[string][2]uint64{}
+	err := db.View(func(txn *badger.Txn) error {
+		for _, key := range watched {
+			versions, err := watchedVersions(txn, key)
+			if err != nil {
+				return err
+			}
+			current[string(key)] = versions
+		}
+		return nil
+	})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range watched {
+		versions, ok := current[string(key)]
+		for c := range w.keys[string(key)] {
+			if err != nil || !ok {
+				// the versions could not be read, assume the key changed
+				w.dirty[c] = true
+				continue
+			}
+			for _, watchedKey := range c.watched {
+				if bytes.Equal(watchedKey.key, key) && watchedKey.versions != versions {
+					w.dirty[c] = true
+				}
+			}
+		}
+	}
+}
+
+func (w *watchRegistry) isDirty(c *client) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirty[c]
+}
+
+func multi(c *client, args [][]byte) (interface{}, error) {
+	if c.multi != nil {
+		return nil, ErrNestedMulti
+	}
+	c.multi = &multiState{}
+	return "OK", nil
+}
+
+func discard(c *client, args [][]byte) (interface{}, error) {
+	if c.multi == nil {
+		return nil, ErrDiscardWithoutMulti
+	}
+	c.multi = nil
+	watches.unwatch(c)
+	return "OK", nil
+}
+
+func watch(c *client, args [][]byte) (interface{}, error) {
+	if c.multi != nil {
+		return nil, ErrWatchInMulti
+	}
+	for _, key := range args[1:] {
+		var versions [2]uint64
+		err := db.View(func(txn *badger.Txn) error {
+			var err error
+			versions, err = watchedVersions(txn, key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		watches.watch(c, key, versions)
+	}
+	return "OK", nil
+}
+
+func unwatch(c *client, args [][]byte) (interface{}, error) {
+	watches.unwatch(c)
+	return "OK", nil
+}
+
+// exec runs the queued commands in a single badger transaction, so either all their
+// writes are committed or none is. It replies with a null array, without running
+// anything, when a watched key changed since WATCH. A transaction which conflicts with
+// a concurrent write to other keys is run again, nothing was replied yet, unless it
+// queued a command with effects outside of the transaction.
+func exec(c *client, args [][]byte) (interface{}, error) {
+	state := c.multi
+	if state == nil {
+		return nil, ErrExecWithoutMulti
+	}
+	c.multi = nil
+	defer watches.unwatch(c)
+	if state.failed {
+		return nil, ErrExecAbort
+	}
+
+	var replies []interface{}
+	var err error
+	if state.transactional() {
+		err = retryConflicts(func() error {
+			replies, err = execQueued(c, state)
+			return err
+		})
+	} else {
+		replies, err = execQueued(c, state)
+		if err == badger.ErrConflict {
+			atomic.AddInt64(&conflictStats.conflicts, 1)
+			atomic.AddInt64(&conflictStats.failures, 1)
+			err = ErrExecConflict
+		}
+	}
+	if err == errWatchedKeyChanged {
+		return respNullArray{}, nil
+	}
+	return replies, err
+}
+
+// errWatchedKeyChanged tells exec a watched key was written since WATCH
+var errWatchedKeyChanged = errors.New("watched key changed")
+
+func execQueued(c *client, state *multiState) ([]interface{}, error) {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	changed, err := watchedKeysChanged(c, txn)
+	if err != nil {
+		return nil, err
+	}
+	if changed || watches.isDirty(c) {
+		return nil, errWatchedKeyChanged
+	}
+
+	c.txn = txn
+	c.keyspaceEvents = nil
+	c.writtenKeys = nil
+	defer func() { c.txn = nil }()
+	replies := make([]interface{}, 0, len(state.commands))
+	for _, queued := range state.commands {
+		// the user may have lost the permission since the command was queued
+		err := acl.checkPermission(c.currentUser(), queued.cmd, queued.args)
+		if err != nil {
+			replies = append(replies, err)
+			continue
+		}
+		result, err := call(c, queued.cmd, queued.args)
+		if err == ErrTooManyWrites || err == badger.ErrTxnTooBig {
+			// the command may have written part of what it meant to, the whole
+			// transaction is discarded so that none of it is committed
+			c.keyspaceEvents = nil
+			c.writtenKeys = nil
+			return nil, ErrTooManyWrites
+		} else if err != nil {
+			result = err
+		}
+		replies = append(replies, result)
+	}
+
+	err = txn.Commit()
+	if err == badger.ErrTxnTooBig {
+		err = ErrTooManyWrites
+	}
+	if err == badger.ErrConflict && len(c.watched) > 0 {
+		// the conflict may be on a key nobody watched, the transaction is then retried
+		viewErr := db.View(func(txn *badger.Txn) error {
+			var viewErr error
+			changed, viewErr = watchedKeysChanged(c, txn)
+			return viewErr
+		})
+		if viewErr != nil {
+			err = viewErr
+		} else if changed {
+			err = errWatchedKeyChanged
+		}
+	}
+	if err != nil {
+		c.keyspaceEvents = nil
+		c.writtenKeys = nil
+		return nil, err
+	}
+	watches.touch(c.writtenKeys)
+	blocking.signal(c.writtenKeys)
+	c.writtenKeys = nil
+	publishQueuedKeyspaceEvents(c)
+	return replies, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newClient(nil)
+	second := newClient(nil)
+	testCases := []struct {
+		title   string
+		client  *client
+		command string
+		reply   interface{}
+	}{
+		{"setup", first, "RPUSH src a b c", int64(3)},
+		{"exec without multi", first, "EXEC", ErrExecWithoutMulti},
+		{"multi", first, "MULTI", "OK"},
+		{"queued pop", first, "RPOP src", "QUEUED"},
+		{"queued push", first, "LPUSH dst x", "QUEUED"},
+		{"nested multi", first, "MULTI", ErrNestedMulti},
+		{"exec", first, "EXEC", []interface{}{[]byte("c"), int64(1)}},
+		{"committed", first, "LRANGE dst 0 -1", [][]byte{[]byte("x")}},
+		{"queue error", first, "MULTI", "OK"},
+		{"wrong arity", first, "LPUSH dst", nil},
+		{"aborted exec", first, "EXEC", ErrExecAbort},
+		{"discard", first, "MULTI", "OK"},
+		{"discarded push", first, "LPUSH dst y", "QUEUED"},
+		{"discard", first, "DISCARD", "OK"},
+		{"nothing pushed", first, "LLEN dst", int64(1)},
+		{"watch", first, "WATCH src", "OK"},
+		{"watch in multi", first, "MULTI", "OK"},
+		{"watch in multi", first, "WATCH dst", ErrWatchInMulti},
+		{"queued pop", first, "RPOP src", "QUEUED"},
+		{"concurrent write", second, "LPUSH src z", int64(3)},
+		{"watched key changed", first, "EXEC", respNullArray{}},
+		{"not popped", first, "LLEN src", int64(3)},
+		{"watch", first, "WATCH src", "OK"},
+		{"multi", first, "MULTI", "OK"},
+		{"queued read", first, "LLEN src", "QUEUED"},
+		{"concurrent read", second, "LLEN src", int64(3)},
+		{"watched key unchanged", first, "EXEC", []interface{}{int64(3)}},
+	}
+
+	for _, testCase := range testCases {
+		args := [][]byte{}
+		for _, arg := range strings.Fields(testCase.command) {
+			args = append(args, []byte(arg))
+		}
+		reply, err := dispatch(testCase.client, args)
+		if err != nil {
+			reply = err
+		}
+		if testCase.reply == nil {
+			// only an error is expected
+			if err == nil {
+				t.Fatalf("Case \"%s\":\n Expected an error\n Actual reply=%v", testCase.title, reply)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(reply, testCase.reply) {
+			t.Fatalf("Case \"%s\":\n Expected reply=%#v\n Actual reply=%#v", testCase.title, testCase.reply, reply)
+		}
+	}
+}
+
+// dispatchFields runs a command given as space separated arguments
+func dispatchFields(c *client, command string) (interface{}, error) {
+	args := [][]byte{}
+	for _, arg := range strings.Fields(command) {
+		args = append(args, []byte(arg))
+	}
+	return dispatch(c, args)
+}
+
+func TestWatchInterleavedWrites(t *testing.T) {
+	// interleave writes to "other" from inside the transaction, the first time it runs
+	interleaved := int32(0)
+	defer addTestCommand("interleave", func(c *client, args [][]byte) (interface{}, error) {
+		if atomic.AddInt32(&interleaved, 1) > 1 {
+			return "OK", nil
+		}
+		return "OK", db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("other"), []byte("changed"))
+		})
+	})()
+
+	testCases := []struct {
+		title string
+		// write runs between WATCH and EXEC, it starts before WATCH and is committed
+		// after it, as a write running concurrently with WATCH would be
+		write   func(txn *badger.Txn) error
+		queued  []string
+		reply   interface{}
+		retries int64
+	}{
+		{
+			"list write committed after WATCH",
+			func(txn *badger.Txn) error {
+				_, err := listPush(txn, []byte("key"), [][]byte{[]byte("z")}, DirectionRight)
+				return err
+			},
+			[]string{"LLEN key"},
+			respNullArray{},
+			0,
+		},
+		{
+			"list element set after WATCH",
+			func(txn *badger.Txn) error {
+				return listSet(txn, []byte("key"), []byte("z"), 0)
+			},
+			[]string{"LLEN key"},
+			respNullArray{},
+			0,
+		},
+		{
+			"string write committed after WATCH",
+			func(txn *badger.Txn) error {
+				return txn.Set([]byte("string"), []byte("z"))
+			},
+			[]string{"LLEN key"},
+			respNullArray{},
+			0,
+		},
+		{
+			"conflict on a key nobody watched",
+			nil,
+			[]string{"GET other", "INTERLEAVE", "SET written 1"},
+			[]interface{}{[]byte("changed"), "OK", "OK"},
+			1,
+		},
+		{
+			"conflict with a command acting outside of the transaction",
+			nil,
+			[]string{"GET other", "INTERLEAVE", "PUBLISH channel message", "SET written 1"},
+			ErrExecConflict,
+			0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		err := db.DropAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&interleaved, 0)
+		c := newClient(nil)
+		for _, command := range []string{"RPUSH key a b", "SET string s", "SET other o"} {
+			_, err := dispatchFields(c, command)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writer := db.NewTransaction(true)
+		if testCase.write != nil {
+			err = testCase.write(writer)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = dispatchFields(c, "WATCH key string")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the writes of the transaction only fail the ones watching them once committed
+		watcher := newClient(nil)
+		_, err = dispatchFields(watcher, "WATCH written")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		retries := atomic.LoadInt64(&conflictStats.retries)
+		for _, command := range append([]string{"MULTI"}, testCase.queued...) {
+			_, err := dispatchFields(c, command)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		reply, err := dispatchFields(c, "EXEC")
+		retries = atomic.LoadInt64(&conflictStats.retries) - retries
+		if err != nil {
+			reply = err
+		}
+		if !reflect.DeepEqual(reply, testCase.reply) || retries != testCase.retries {
+			t.Fatalf("Case \"%s\":\n Expected reply=%#v, retries=%d\n Actual reply=%#v, retries=%d, err=%v", testCase.title, testCase.reply, testCase.retries, reply, retries, err)
+		}
+		dirty := watches.isDirty(watcher)
+		watches.unwatch(watcher)
+		written := db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("written"))
+			return err
+		}) == nil
+		if dirty != written {
+			t.Fatalf("Case \"%s\":\n Expected watcher dirty=%v\n Actual dirty=%v", testCase.title, written, dirty)
+		}
+	}
+}
+
+func TestExecRevokedPermission(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = acl.setUser("writer", []string{"on", "nopass", "allkeys", "+@all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acl.deleteUsers([]string{"writer"})
+	u, err := acl.authenticate([]byte("writer"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(nil)
+	c.setUser(u)
+
+	for _, command := range []string{"MULTI", "LPUSH key x", "LLEN key"} {
+		_, err = dispatchFields(c, command)
+		if err != nil {
+			t.Fatalf("%s: Expected no error, Actual %v", command, err)
+		}
+	}
+	err = acl.setUser("writer", []string{"-lpush"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := dispatchFields(c, "EXEC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := reply.([]interface{})
+	if len(replies) != 2 || replies[1] != int64(0) {
+		t.Fatalf("Expected the push to be refused and the length to be 0, Actual %#v", replies)
+	}
+	if _, ok := replies[0].(error); !ok || !strings.HasPrefix(replies[0].(error).Error(), "NOPERM") {
+		t.Fatalf("Expected a NOPERM error, Actual %#v", replies[0])
+	}
+}
+
+func TestWatchNoopWrites(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newClient(nil)
+	second := newClient(nil)
+	_, err = dispatchFields(first, "SET string s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		title  string
+		writes []string
+		reply  interface{}
+	}{
+		{"push to a missing list", []string{"LPUSHX key x", "RPUSHX key x"}, []interface{}{"OK"}},
+		{"pop from a missing list", []string{"LPOP key", "RPOP key 2"}, []interface{}{"OK"}},
+		{"blocking pop timing out", []string{"BLPOP key 0.01", "BLMOVE key other LEFT RIGHT 0.01"}, []interface{}{"OK"}},
+		{"wrong type", []string{"LPUSH string x"}, []interface{}{"OK"}},
+		{"write", []string{"RPUSH key x"}, respNullArray{}},
+		{"write undone", []string{"RPUSH key x", "LPOP key"}, respNullArray{}},
+	}
+	for _, testCase := range testCases {
+		for _, command := range []string{"WATCH key string", "MULTI", "SET done 1"} {
+			_, err = dispatchFields(first, command)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, command := range testCase.writes {
+			// failing writes are part of the test, their errors are not checked
+			dispatchFields(second, command)
+		}
+		reply, err := dispatchFields(first, "EXEC")
+		if err != nil || !reflect.DeepEqual(reply, testCase.reply) {
+			t.Fatalf("Case \"%s\":\n Expected reply=%#v\n Actual reply=%#v, err=%v", testCase.title, testCase.reply, reply, err)
+		}
+	}
+}
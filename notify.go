@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Keyspace event classes, named after the notify-keyspace-events flag letters of redis
+const (
+	// notifyKeyspace publishes events to __keyspace@<db>__:<key> with the event name
+	notifyKeyspace = 1 << iota
+	// notifyKeyevent publishes events to __keyevent@<db>__:<event> with the key
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZset
+	notifyExpired
+	notifyEvicted
+	notifyStream
+	notifyKeyMiss
+	notifyModule
+	notifyNew
+)
+
+// notifyAll is what the A flag stands for, key misses and new keys are left out the
+// same way redis does
+const notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+
+var notifyFlagLetters = []struct {
+	letter byte
+	class  int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'m', notifyKeyMiss},
+	{'d', notifyModule},
+	{'n', notifyNew},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+}
+
+// keyspaceEvents holds the enabled classes, set from notify-keyspace-events. Nothing
+// is published unless K or E and at least one event class are enabled.
+var keyspaceEvents int64
+
+func setKeyspaceEvents(classes int) {
+	atomic.StoreInt64(&keyspaceEvents, int64(classes))
+}
+
+// parseNotifyFlags converts notify-keyspace-events flags like KEA or Elg to classes
+func parseNotifyFlags(flags string) (int, error) {
+	classes := 0
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'A' {
+			classes |= notifyAll
+			continue
+		}
+		found := false
+		for _, flag := range notifyFlagLetters {
+			if flag.letter == flags[i] {
+				classes |= flag.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid flag '%c'", flags[i])
+		}
+	}
+	return classes, nil
+}
+
+// formatNotifyFlags is the opposite of parseNotifyFlags, A is used when every class it
+// stands for is enabled
+func formatNotifyFlags(classes int) string {
+	flags := []byte{}
+	if classes&notifyAll == notifyAll {
+		flags = append(flags, 'A')
+	}
+	for _, flag := range notifyFlagLetters {
+		if classes&notifyAll == notifyAll && flag.class&notifyAll != 0 {
+			continue
+		}
+		if classes&flag.class != 0 {
+			flags = append(flags, flag.letter)
+		}
+	}
+	return string(flags)
+}
+
+// keyspaceEvent is an event of a command run by EXEC, it is published once the
+// transaction is committed
+type keyspaceEvent struct {
+	class int
+	event string
+	key   []byte
+}
+
+// notifyKeyspaceEvent publishes that event happened to key, if its class is enabled.
+// It must be called once the write is done, events of commands run by EXEC wait for the
+// transaction to be committed.
+func notifyKeyspaceEvent(c *client, class int, event string, key []byte) {
+	classes := int(atomic.LoadInt64(&keyspaceEvents))
+	if classes&class == 0 || classes&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+	if c.txn != nil {
+		c.keyspaceEvents = append(c.keyspaceEvents, keyspaceEvent{class, event, key})
+		return
+	}
+	publishKeyspaceEvent(classes, c.db, event, key)
+}
+
+func publishKeyspaceEvent(classes int, db int, event string, key []byte) {
+	dbStr := strconv.Itoa(db)
+	if classes&notifyKeyspace != 0 {
+		channel := append([]byte("__keyspace@"+dbStr+"__:"), key...)
+		pubsub.publish(channel, []byte(event))
+	}
+	if classes&notifyKeyevent != 0 {
+		pubsub.publish([]byte("__keyevent@"+dbStr+"__:"+event), key)
+	}
+}
+
+// publishQueuedKeyspaceEvents publishes the events of a committed EXEC
+func publishQueuedKeyspaceEvents(c *client) {
+	classes := int(atomic.LoadInt64(&keyspaceEvents))
+	for _, event := range c.keyspaceEvents {
+		if classes&event.class != 0 {
+			publishKeyspaceEvent(classes, c.db, event.event, event.key)
+		}
+	}
+	c.keyspaceEvents = nil
+}
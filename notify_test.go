@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseNotifyFlags(t *testing.T) {
+	testCases := []struct {
+		title     string
+		flags     string
+		classes   int
+		formatted string
+		err       bool
+	}{
+		{"disabled", "", 0, "", false},
+		{"everything", "KEA", notifyKeyspace | notifyKeyevent | notifyAll, "AKE", false},
+		{"list events", "El", notifyKeyevent | notifyList, "lE", false},
+		{"key misses are not part of A", "KAm", notifyKeyspace | notifyAll | notifyKeyMiss, "AmK", false},
+		{"unknown flag", "KEq", 0, "", true},
+	}
+
+	for _, testCase := range testCases {
+		classes, err := parseNotifyFlags(testCase.flags)
+		if (err != nil) != testCase.err {
+			t.Fatalf("Case \"%s\":\n Expected error=%v\n Actual error=%v", testCase.title, testCase.err, err)
+		}
+		if testCase.err {
+			continue
+		}
+		if classes != testCase.classes || formatNotifyFlags(classes) != testCase.formatted {
+			t.Fatalf("Case \"%s\":\n Expected classes=%b, formatted=%q\n Actual classes=%b, formatted=%q", testCase.title, testCase.classes, testCase.formatted, classes, formatNotifyFlags(classes))
+		}
+	}
+}
+
+// keyspaceEventMessages are the messages a subscriber to __key*@0__:* gets for event
+func keyspaceEventMessages(key, event string) string {
+	message := func(channel, payload string) string {
+		return fmt.Sprintf("*4\r\n$8\r\npmessage\r\n$12\r\n__key*@0__:*\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+	}
+	return message("__keyspace@0__:"+key, event) + message("__keyevent@0__:"+event, key)
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setKeyspaceEvents(notifyKeyspace | notifyKeyevent | notifyList | notifyGeneric)
+	defer setKeyspaceEvents(0)
+
+	s := newServer()
+	defer s.Shutdown(time.Second)
+	err = s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+
+	subscriber, subscriberReader := dialTestClient(t, addr)
+	defer subscriber.Close()
+	writer, writerReader := dialTestClient(t, addr)
+	defer writer.Close()
+
+	testCases := []struct {
+		title   string
+		command string
+		reply   string
+		events  string
+	}{
+		{"push", "RPUSH queue a", ":1\r\n", keyspaceEventMessages("queue", "rpush")},
+		{"string class disabled", "SET name value", "+OK\r\n", ""},
+		{"set", "LSET queue 0 b", "+OK\r\n", keyspaceEventMessages("queue", "lset")},
+		{"pop of the last element", "LPOP queue", "$1\r\nb\r\n", keyspaceEventMessages("queue", "lpop") + keyspaceEventMessages("queue", "del")},
+		{"failed write", "LSET missing 0 b", "-ERR no such key\r\n", ""},
+	}
+
+	subscriber.Write([]byte("PSUBSCRIBE __key*@0__:*\r\n"))
+	confirmation := make([]byte, len("*3\r\n$10\r\npsubscribe\r\n$12\r\n__key*@0__:*\r\n:1\r\n"))
+	_, err = io.ReadFull(subscriberReader, confirmation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range testCases {
+		writer.Write([]byte(testCase.command + "\r\n"))
+		reply := make([]byte, len(testCase.reply))
+		_, err := io.ReadFull(writerReader, reply)
+		if err != nil || string(reply) != testCase.reply {
+			t.Fatalf("Case \"%s\":\n Expected reply=%q\n Actual reply=%q, err=%v", testCase.title, testCase.reply, reply, err)
+		}
+		// a PING from the subscriber makes sure no unexpected event comes before the
+		// expected ones
+		subscriber.Write([]byte("PING\r\n"))
+		expected := testCase.events + "*2\r\n$4\r\npong\r\n$0\r\n\r\n"
+		events := make([]byte, len(expected))
+		_, err = io.ReadFull(subscriberReader, events)
+		if err != nil || string(events) != expected {
+			t.Fatalf("Case \"%s\":\n Expected events=%q\n Actual events=%q, err=%v", testCase.title, expected, events, err)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxInlineSize is the longest inline command accepted, the same limit redis uses
+	maxInlineSize = 64 * 1024
+	// maxMultibulkLength is the highest number of arguments in a single command
+	maxMultibulkLength = 1024 * 1024
+	// maxBulkLength is the size of the largest argument, 512MB like redis' proto-max-bulk-len
+	maxBulkLength = 512 * 1024 * 1024
+	// maxUnauthenticatedMultibulkLength and maxUnauthenticatedBulkLength are the lower
+	// limits redis applies to clients which did not authenticate yet
+	maxUnauthenticatedMultibulkLength = 10
+	maxUnauthenticatedBulkLength      = 16 * 1024
+	// argsPreallocLength is how many arguments are allocated from the multibulk header,
+	// more are allocated as they arrive
+	argsPreallocLength = 1024
+	// bulkReadStep is how much of an argument is read at once, the argument grows as the
+	// data arrives instead of being allocated from its header
+	bulkReadStep = 64 * 1024
+)
+
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes")
+
+// protocolError is returned by requestReader when the input is not valid RESP nor a
+// valid inline command, nothing after it can be parsed so the connection must be closed
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+var (
+	ErrProtocolInvalidMultibulkLength = protocolError("invalid multibulk length")
+	ErrProtocolInvalidBulkLength      = protocolError("invalid bulk length")
+	ErrProtocolTooBigInline           = protocolError("too big inline request")
+	ErrProtocolTooBigMultibulk        = protocolError("too big mbulk count string")
+	ErrProtocolUnbalancedQuotes       = protocolError("unbalanced quotes in request")
+
+	ErrProtocolUnauthenticatedMultibulkLength = protocolError("unauthenticated multibulk length")
+	ErrProtocolUnauthenticatedBulkLength      = protocolError("unauthenticated bulk length")
+)
+
+// requestReader reads commands sent by clients, both as RESP arrays of bulk strings
+// (multibulk) and as inline commands, which are plain lines of space separated
+// arguments used by telnet sessions and health checks
+type requestReader struct {
+	reader *bufio.Reader
+	// unauthenticated tells whether the client still has to authenticate, its
+	// commands are then held to lower limits. It is nil for readers without clients.
+	unauthenticated func() bool
+}
+
+func newRequestReader(reader io.Reader) *requestReader {
+	return &requestReader{reader: bufio.NewReaderSize(reader, ioBufferSize)}
+}
+
+// Buffered returns the number of bytes already received but not parsed yet, when it is
+// not zero the client has pipelined more commands
+func (r *requestReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// ReadCommand returns the arguments of the next command, an empty command is
+// returned for blank lines and empty arrays
+func (r *requestReader) ReadCommand() ([][]byte, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] == '*' {
+		return r.readMultibulk()
+	}
+	return r.readInline()
+}
+
+// readLine reads a line terminated by \n without the terminator and an optional \r
+// before it, lines longer than limit are rejected with tooLong
+func (r *requestReader) readLine(limit int, tooLong error) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, tooLong
+		}
+		if err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line)+len(chunk) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if line == nil {
+			// chunk is only valid until the next read, callers keep the line around
+			line = make([]byte, 0, len(chunk))
+		}
+		line = append(line, chunk...)
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return line, nil
+	}
+}
+
+func (r *requestReader) readInline() ([][]byte, error) {
+	line, err := r.readLine(maxInlineSize, ErrProtocolTooBigInline)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := splitArgs(line)
+	if err != nil {
+		return nil, ErrProtocolUnbalancedQuotes
+	}
+	return args, nil
+}
+
+func (r *requestReader) readMultibulk() ([][]byte, error) {
+	line, err := r.readLine(maxInlineSize, ErrProtocolTooBigMultibulk)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || count > maxMultibulkLength {
+		return nil, ErrProtocolInvalidMultibulkLength
+	}
+	if count <= 0 {
+		return [][]byte{}, nil
+	}
+	unauthenticated := r.unauthenticated != nil && r.unauthenticated()
+	if unauthenticated && count > maxUnauthenticatedMultibulkLength {
+		return nil, ErrProtocolUnauthenticatedMultibulkLength
+	}
+
+	prealloc := count
+	if prealloc > argsPreallocLength {
+		prealloc = argsPreallocLength
+	}
+	args := make([][]byte, 0, prealloc)
+	for i := int64(0); i < count; i++ {
+		line, err = r.readLine(maxInlineSize, ErrProtocolTooBigMultibulk)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			got := "''"
+			if len(line) > 0 {
+				got = "'" + string(line[0]) + "'"
+			}
+			return nil, protocolError("expected '$', got " + got)
+		}
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, ErrProtocolInvalidBulkLength
+		}
+		if unauthenticated && size > maxUnauthenticatedBulkLength {
+			return nil, ErrProtocolUnauthenticatedBulkLength
+		}
+
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads an argument of size bytes and its terminator. The argument is read in
+// steps of at most bulkReadStep and grows as they arrive, so a client cannot make the
+// server allocate more than about twice what it actually sent.
+func (r *requestReader) readBulk(size int64) ([]byte, error) {
+	total := size + 2
+	initial := total
+	if initial > bulkReadStep {
+		initial = bulkReadStep
+	}
+	arg := make([]byte, 0, initial)
+	for int64(len(arg)) < total {
+		step := total - int64(len(arg))
+		if step > bulkReadStep {
+			step = bulkReadStep
+		}
+		start := len(arg)
+		if int64(cap(arg)-start) < step {
+			capacity := 2*int64(cap(arg)) + step
+			if capacity > total {
+				capacity = total
+			}
+			grown := make([]byte, start, capacity)
+			copy(grown, arg)
+			arg = grown
+		}
+		arg = arg[:start+int(step)]
+		_, err := io.ReadFull(r.reader, arg[start:])
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.HasSuffix(arg, []byte{'\r', '\n'}) {
+		return nil, ErrProtocolInvalidBulkLength
+	}
+	return arg[:size], nil
+}
+
+// splitArgs splits a line into arguments the same way redis does for inline commands
+// and its config file, arguments are separated by spaces, "double quoted" arguments
+// support escape sequences like \n, \t and \xff, 'single quoted' ones only support \'
+func splitArgs(line []byte) ([][]byte, error) {
+	args := [][]byte{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		inDoubleQuotes := false
+		inSingleQuotes := false
+		arg := []byte{}
+		done := false
+		for !done {
+			if inDoubleQuotes {
+				if i == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					value, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(value))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else if inSingleQuotes {
+				if i == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	testCases := []struct {
+		title string
+		input string
+		args  [][]byte
+		err   error
+	}{
+		{"multibulk", "*2\r\n$4\r\nLLEN\r\n$3\r\nkey\r\n", [][]byte{[]byte("LLEN"), []byte("key")}, nil},
+		{"binary safe multibulk", "*1\r\n$4\r\na\r\nb\r\n", [][]byte{[]byte("a\r\nb")}, nil},
+		{"empty multibulk", "*0\r\n", [][]byte{}, nil},
+		{"inline", "LPUSH key value\r\n", [][]byte{[]byte("LPUSH"), []byte("key"), []byte("value")}, nil},
+		{"inline without carriage return", "PING\n", [][]byte{[]byte("PING")}, nil},
+		{"quoted inline", "SET key \"hello world\"\r\n", [][]byte{[]byte("SET"), []byte("key"), []byte("hello world")}, nil},
+		{"blank inline", "\r\n", [][]byte{}, nil},
+		{"unbalanced quotes", "SET key \"value\r\n", nil, ErrProtocolUnbalancedQuotes},
+		{"invalid multibulk length", "*x\r\n", nil, ErrProtocolInvalidMultibulkLength},
+		{"invalid bulk length", "*1\r\n$-1\r\n", nil, ErrProtocolInvalidBulkLength},
+		{"bad bulk terminator", "*1\r\n$2\r\nabc\r\n", nil, ErrProtocolInvalidBulkLength},
+		{"missing dollar", "*1\r\n:1\r\n", nil, protocolError("expected '$', got ':'")},
+		{"truncated multibulk", "*2\r\n$4\r\nLLEN\r\n", nil, io.ErrUnexpectedEOF},
+		{"truncated bulk", "*1\r\n$4\r\nLL", nil, io.ErrUnexpectedEOF},
+		{"too big inline", string(bytes.Repeat([]byte{'a'}, maxInlineSize+1)), nil, ErrProtocolTooBigInline},
+	}
+
+	for _, testCase := range testCases {
+		reader := newRequestReader(bytes.NewReader([]byte(testCase.input)))
+		args, err := reader.ReadCommand()
+		if err != testCase.err || !reflect.DeepEqual(args, testCase.args) {
+			t.Fatalf("Case \"%s\":\nExpected args=%q, err=%v\nActual args=%q, err=%v", testCase.title, testCase.args, testCase.err, args, err)
+		}
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	large := strings.Repeat("x", 3*bulkReadStep+5)
+	testCases := []struct {
+		title           string
+		input           string
+		unauthenticated bool
+		args            [][]byte
+		err             error
+	}{
+		{"argument read in steps", "*1\r\n$" + strconv.Itoa(len(large)) + "\r\n" + large + "\r\n", false, [][]byte{[]byte(large)}, nil},
+		{"truncated large argument", "*1\r\n$" + strconv.Itoa(len(large)) + "\r\n" + large[:bulkReadStep], false, nil, io.ErrUnexpectedEOF},
+		{"unauthenticated command", "*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n", true, [][]byte{[]byte("AUTH"), []byte("secret")}, nil},
+		{"unauthenticated multibulk length", "*11\r\n", true, nil, ErrProtocolUnauthenticatedMultibulkLength},
+		{"unauthenticated bulk length", "*1\r\n$16385\r\n", true, nil, ErrProtocolUnauthenticatedBulkLength},
+		{"authenticated bulk length", "*1\r\n$16385\r\n", false, nil, io.ErrUnexpectedEOF},
+	}
+
+	for _, testCase := range testCases {
+		reader := newRequestReader(strings.NewReader(testCase.input))
+		unauthenticated := testCase.unauthenticated
+		reader.unauthenticated = func() bool { return unauthenticated }
+		args, err := reader.ReadCommand()
+		if err != testCase.err || !reflect.DeepEqual(args, testCase.args) {
+			t.Fatalf("Case \"%s\":\nExpected args=%.20q, err=%v\nActual args=%.20q, err=%v", testCase.title, testCase.args, testCase.err, args, err)
+		}
+	}
+}
+
+func TestReadCommandAllocations(t *testing.T) {
+	// headers announcing the largest command, followed by almost no data
+	input := "*" + strconv.Itoa(maxMultibulkLength) + "\r\n$" + strconv.Itoa(maxBulkLength) + "\r\nab"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := newRequestReader(strings.NewReader(input)).ReadCommand()
+	runtime.ReadMemStats(&after)
+
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if err != io.ErrUnexpectedEOF || allocated > 1024*1024 {
+		t.Fatalf("Expected err=%v and less than 1MB allocated\nActual err=%v, allocated=%d", io.ErrUnexpectedEOF, err, allocated)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	testCases := []struct {
+		line string
+		args [][]byte
+		err  error
+	}{
+		{"", [][]byte{}, nil},
+		{"   ", [][]byte{}, nil},
+		{"port 6379", [][]byte{[]byte("port"), []byte("6379")}, nil},
+		{"  bind\t127.0.0.1   ::1 ", [][]byte{[]byte("bind"), []byte("127.0.0.1"), []byte("::1")}, nil},
+		{`dir "/var/lib/my data"`, [][]byte{[]byte("dir"), []byte("/var/lib/my data")}, nil},
+		{`set "a\tb\x41\n" ''`, [][]byte{[]byte("set"), []byte("a\tbA\n"), []byte{}}, nil},
+		{`set 'it\'s'`, [][]byte{[]byte("set"), []byte("it's")}, nil},
+		{`set "foo`, nil, ErrUnbalancedQuotes},
+		{`set "foo"bar`, nil, ErrUnbalancedQuotes},
+		{`set 'foo`, nil, ErrUnbalancedQuotes},
+	}
+
+	for _, testCase := range testCases {
+		args, err := splitArgs([]byte(testCase.line))
+		if err != testCase.err || !reflect.DeepEqual(args, testCase.args) {
+			t.Fatalf("Case %q:\nExpected args=%q, err=%v\nActual args=%q, err=%v", testCase.line, testCase.args, testCase.err, args, err)
+		}
+	}
+}
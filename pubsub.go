@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subscribedModeCommands are the only commands a RESP2 client can send once it
+// subscribed to a channel or pattern, its connection only carries messages from then on
+var subscribedModeCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// OutputBufferLimit bounds the messages waiting to be sent to a subscriber. A client
+// is disconnected as soon as they take more than Hard bytes, or when they take more
+// than Soft bytes for SoftSeconds in a row. A zero limit is disabled.
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int
+}
+
+// pubsubRegistry tracks which clients subscribed to which channels and patterns
+type pubsubRegistry struct {
+	mu       sync.RWMutex
+	channels map[string]map[*client]struct{}
+	patterns map[string]map[*client]struct{}
+}
+
+var pubsub = &pubsubRegistry{
+	channels: map[string]map[*client]struct{}{},
+	patterns: map[string]map[*client]struct{}{},
+}
+
+// subscribe adds c to the subscribers of name in subscribers, it returns false if c
+// already subscribed to it
+func (p *pubsubRegistry) subscribe(subscribers map[string]map[*client]struct{}, subscriptions map[string]bool, c *client, name string) bool {
+	if subscriptions[name] {
+		return false
+	}
+	clients, ok := subscribers[name]
+	if !ok {
+		clients = map[*client]struct{}{}
+		subscribers[name] = clients
+	}
+	clients[c] = struct{}{}
+	subscriptions[name] = true
+	return true
+}
+
+func (p *pubsubRegistry) unsubscribe(subscribers map[string]map[*client]struct{}, subscriptions map[string]bool, c *client, name string) bool {
+	if !subscriptions[name] {
+		return false
+	}
+	clients := subscribers[name]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(subscribers, name)
+	}
+	delete(subscriptions, name)
+	return true
+}
+
+// unsubscribeAll forgets every subscription of a client which disconnected
+func (p *pubsubRegistry) unsubscribeAll(c *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for channel := range c.subscriptions {
+		p.unsubscribe(p.channels, c.subscriptions, c, channel)
+	}
+	for pattern := range c.patterns {
+		p.unsubscribe(p.patterns, c.patterns, c, pattern)
+	}
+}
+
+// subscriptionCounts returns how many channels and patterns c subscribed to
+func (p *pubsubRegistry) subscriptionCounts(c *client) (int, int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(c.subscriptions), len(c.patterns)
+}
+
+// publish sends message to the subscribers of channel and to the clients which
+// subscribed to a matching pattern, it returns how many clients received it
+func (p *pubsubRegistry) publish(channel, message []byte) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	receivers := 0
+	for c := range p.channels[string(channel)] {
+		c.push(respPush{[]byte("message"), channel, message})
+		receivers++
+	}
+	for pattern, clients := range p.patterns {
+		if !globMatch([]byte(pattern), channel) {
+			continue
+		}
+		for c := range clients {
+			c.push(respPush{[]byte("pmessage"), []byte(pattern), channel, message})
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// isSubscribed tells whether the client subscribed to a channel or a pattern. It must
+// be called by the client goroutine, the only one changing its subscriptions.
+func (c *client) isSubscribed() bool {
+	return len(c.subscriptions) > 0 || len(c.patterns) > 0
+}
+
+// startPushing starts the goroutine writing the messages published to the client,
+// the first time it subscribes
+func (c *client) startPushing() {
+	if c.pushed != nil {
+		return
+	}
+	c.pushed = make(chan struct{}, 1)
+	c.pushDone = make(chan struct{})
+	go c.pushLoop()
+}
+
+// stopPushing stops pushLoop once the client disconnected and unsubscribed from
+// everything, the messages not sent yet are dropped
+func (c *client) stopPushing() {
+	c.pushMu.Lock()
+	c.pushClosed = true
+	c.pending = nil
+	c.pushMu.Unlock()
+	if c.pushDone != nil {
+		close(c.pushDone)
+	}
+}
+
+// messageSize estimates how many bytes message takes once encoded
+func messageSize(message respPush) int64 {
+	size := int64(16)
+	for _, element := range message {
+		size += int64(len(element.([]byte))) + 16
+	}
+	return size
+}
+
+// push queues a published message for pushLoop. The message is dropped, and the client
+// disconnected, when it reads its messages too slowly for the output buffer limit.
+func (c *client) push(message respPush) {
+	c.pushMu.Lock()
+	if c.pushClosed {
+		c.pushMu.Unlock()
+		return
+	}
+	c.pending = append(c.pending, message)
+	c.pendingSize += messageSize(message)
+
+	overLimit := false
+	limit := c.outputLimit
+	if limit.Hard > 0 && c.pendingSize > limit.Hard {
+		overLimit = true
+	} else if limit.Soft > 0 && c.pendingSize > limit.Soft {
+		if c.overSoftLimitSince.IsZero() {
+			c.overSoftLimitSince = time.Now()
+		} else if time.Since(c.overSoftLimitSince) >= time.Duration(limit.SoftSeconds)*time.Second {
+			overLimit = true
+		}
+	} else {
+		c.overSoftLimitSince = time.Time{}
+	}
+	if overLimit {
+		logger.Warn("Closing client over the pubsub output buffer limit",
+			zap.String("addr", c.addr()),
+			zap.Int64("pending", c.pendingSize),
+		)
+		c.pushClosed = true
+		c.pending = nil
+	}
+	c.pushMu.Unlock()
+
+	if overLimit {
+		c.close()
+		return
+	}
+	select {
+	case c.pushed <- struct{}{}:
+	default:
+		// pushLoop was already woken up
+	}
+}
+
+// pushLoop writes the published messages to the client, concurrently with the replies
+// to its commands
+func (c *client) pushLoop() {
+	for {
+		select {
+		case <-c.pushDone:
+			return
+		case <-c.pushed:
+		}
+
+		c.pushMu.Lock()
+		messages := c.pending
+		c.pending = nil
+		c.pushMu.Unlock()
+		if len(messages) == 0 {
+			continue
+		}
+
+		size := int64(0)
+		c.outMu.Lock()
+		var err error
+		for _, message := range messages {
+			size += messageSize(message)
+			if err == nil {
+				err = c.bufferReply(message)
+			}
+		}
+		if err == nil {
+			err = c.writer.Flush()
+		}
+		c.outMu.Unlock()
+
+		c.pushMu.Lock()
+		c.pendingSize -= size
+		c.pushMu.Unlock()
+		if err != nil {
+			logger.Debug("Cannot write to connection", zap.Error(err))
+			c.close()
+		}
+	}
+}
+
+// subscribeReplies registers the subscriptions of a (P)SUBSCRIBE or (P)UNSUBSCRIBE call
+// and writes one confirmation per channel, with the number of subscriptions left. The
+// confirmations are written while holding outMu so they come before the messages
+// published to the new channels, but after releasing the registry lock so a client
+// which does not read its replies cannot block publishers.
+func subscribeReplies(c *client, kind string, names [][]byte, change func(name string)) (interface{}, error) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	confirmations := make([]interface{}, 0, len(names))
+	pubsub.mu.Lock()
+	for _, name := range names {
+		change(string(name))
+		count := int64(len(c.subscriptions) + len(c.patterns))
+		confirmations = append(confirmations, respPush{[]byte(kind), name, count})
+	}
+	pubsub.mu.Unlock()
+
+	for _, confirmation := range confirmations {
+		err := c.bufferReply(confirmation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return noReply, nil
+}
+
+func subscribe(c *client, args [][]byte) (interface{}, error) {
+	c.startPushing()
+	return subscribeReplies(c, "subscribe", args[1:], func(name string) {
+		pubsub.subscribe(pubsub.channels, c.subscriptions, c, name)
+	})
+}
+
+func psubscribe(c *client, args [][]byte) (interface{}, error) {
+	c.startPushing()
+	return subscribeReplies(c, "psubscribe", args[1:], func(name string) {
+		pubsub.subscribe(pubsub.patterns, c.patterns, c, name)
+	})
+}
+
+// unsubscribe without arguments unsubscribes from every channel, a client which
+// subscribed to none still gets one confirmation
+func unsubscribe(c *client, args [][]byte) (interface{}, error) {
+	return unsubscribeReplies(c, "unsubscribe", args[1:], c.subscriptions, pubsub.channels)
+}
+
+func punsubscribe(c *client, args [][]byte) (interface{}, error) {
+	return unsubscribeReplies(c, "punsubscribe", args[1:], c.patterns, pubsub.patterns)
+}
+
+func unsubscribeReplies(c *client, kind string, names [][]byte, subscriptions map[string]bool, subscribers map[string]map[*client]struct{}) (interface{}, error) {
+	if len(names) == 0 {
+		for name := range subscriptions {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool { return string(names[i]) < string(names[j]) })
+	}
+	if len(names) == 0 {
+		count := int64(len(c.subscriptions) + len(c.patterns))
+		return respPush{[]byte(kind), nil, count}, nil
+	}
+	return subscribeReplies(c, kind, names, func(name string) {
+		pubsub.unsubscribe(subscribers, subscriptions, c, name)
+	})
+}
+
+func publish(c *client, args [][]byte) (interface{}, error) {
+	return int64(pubsub.publish(args[1], args[2])), nil
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], PUBSUB NUMSUB [channel ...] and
+// PUBSUB NUMPAT
+func pubsubCommand(c *client, args [][]byte) (interface{}, error) {
+	subcommand := strings.ToUpper(string(args[1]))
+	pubsub.mu.RLock()
+	defer pubsub.mu.RUnlock()
+	switch {
+	case subcommand == "CHANNELS" && len(args) <= 3:
+		channels := [][]byte{}
+		for channel := range pubsub.channels {
+			if len(args) == 3 && !globMatch(args[2], []byte(channel)) {
+				continue
+			}
+			channels = append(channels, []byte(channel))
+		}
+		sort.Slice(channels, func(i, j int) bool { return string(channels[i]) < string(channels[j]) })
+		return channels, nil
+	case subcommand == "NUMSUB":
+		counts := []interface{}{}
+		for _, channel := range args[2:] {
+			counts = append(counts, channel, int64(len(pubsub.channels[string(channel)])))
+		}
+		return counts, nil
+	case subcommand == "NUMPAT" && len(args) == 2:
+		return int64(len(pubsub.patterns)), nil
+	}
+	return nil, fmt.Errorf("ERR Unknown subcommand or wrong number of arguments for '%s'", args[1])
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTestClient connects to addr, the connection fails instead of hanging if a reply
+// does not come
+func dialTestClient(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestPubSub(t *testing.T) {
+	s := newServer()
+	defer s.Shutdown(time.Second)
+	err := s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+
+	subscriber, subscriberReader := dialTestClient(t, addr)
+	defer subscriber.Close()
+	publisher, publisherReader := dialTestClient(t, addr)
+	defer publisher.Close()
+
+	testCases := []struct {
+		title   string
+		conn    net.Conn
+		reader  *bufio.Reader
+		command string
+		reply   string
+	}{
+		{"subscribe", subscriber, subscriberReader, "SUBSCRIBE news sport", "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n"},
+		{"pattern", subscriber, subscriberReader, "PSUBSCRIBE n*", "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n"},
+		{"other command", subscriber, subscriberReader, "GET news", "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n"},
+		{"ping", subscriber, subscriberReader, "PING", "*2\r\n$4\r\npong\r\n$0\r\n\r\n"},
+		{"publish", publisher, publisherReader, "PUBLISH news hello", ":2\r\n"},
+		{"messages", subscriber, subscriberReader, "", "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n"},
+		{"no subscriber", publisher, publisherReader, "PUBLISH weather sunny", ":0\r\n"},
+		{"channels", publisher, publisherReader, "PUBSUB CHANNELS", "*2\r\n$4\r\nnews\r\n$5\r\nsport\r\n"},
+		{"channels matching", publisher, publisherReader, "PUBSUB CHANNELS s*", "*1\r\n$5\r\nsport\r\n"},
+		{"numsub", publisher, publisherReader, "PUBSUB NUMSUB news weather", "*4\r\n$4\r\nnews\r\n:1\r\n$7\r\nweather\r\n:0\r\n"},
+		{"numpat", publisher, publisherReader, "PUBSUB NUMPAT", ":1\r\n"},
+		{"unsubscribe", subscriber, subscriberReader, "UNSUBSCRIBE news", "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n"},
+		{"unsubscribe all", subscriber, subscriberReader, "UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:1\r\n"},
+		{"punsubscribe all", subscriber, subscriberReader, "PUNSUBSCRIBE", "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n"},
+		{"subscribed to nothing", subscriber, subscriberReader, "UNSUBSCRIBE", "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"},
+		{"out of subscribed mode", subscriber, subscriberReader, "PING", "+PONG\r\n"},
+		{"subscribe in multi", publisher, publisherReader, "MULTI", "+OK\r\n"},
+		{"subscribe in multi", publisher, publisherReader, "SUBSCRIBE news", "-ERR Command not allowed inside a transaction\r\n"},
+		{"subscribe in multi", publisher, publisherReader, "EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		if testCase.command != "" {
+			_, err := testCase.conn.Write([]byte(testCase.command + "\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		reply := make([]byte, len(testCase.reply))
+		_, err := io.ReadFull(testCase.reader, reply)
+		if err != nil || string(reply) != testCase.reply {
+			t.Fatalf("Case \"%s\":\n Expected reply=%q\n Actual reply=%q, err=%v", testCase.title, testCase.reply, reply, err)
+		}
+	}
+}
+
+// TestPubSubOutputLimit checks a subscriber which stops reading is disconnected once
+// the messages waiting for it go over the hard limit
+func TestPubSubOutputLimit(t *testing.T) {
+	s := newServer()
+	s.pubsubOutputLimit = OutputBufferLimit{Hard: 1024 * 1024}
+	defer s.Shutdown(time.Second)
+	err := s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+
+	subscriber, subscriberReader := dialTestClient(t, addr)
+	defer subscriber.Close()
+	subscriber.Write([]byte("SUBSCRIBE slow\r\n"))
+	confirmation := make([]byte, len("*3\r\n$9\r\nsubscribe\r\n$4\r\nslow\r\n:1\r\n"))
+	_, err = io.ReadFull(subscriberReader, confirmation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, publisherReader := dialTestClient(t, addr)
+	defer publisher.Close()
+	message := bytes.Repeat([]byte("x"), 64*1024)
+	command := "*3\r\n$7\r\nPUBLISH\r\n$4\r\nslow\r\n$65536\r\n" + string(message) + "\r\n"
+	for i := 0; i < 2000; i++ {
+		publisher.Write([]byte(command))
+		reply, err := publisherReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply == ":0\r\n" {
+			// the subscriber was disconnected
+			return
+		}
+		if !strings.HasPrefix(reply, ":") {
+			t.Fatalf("Expected an integer reply, Actual %q", reply)
+		}
+	}
+	t.Fatalf("Expected the subscriber to be disconnected")
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	badger "github.com/dgraph-io/badger/v2"
+	"sync/atomic"
+)
+
+// internalQuicklistType marks the metadata of lists using the quicklist encoding. Their
+// elements are packed in chunks of at most listChunkSize bytes. first and last are the
+// indexes of the head and tail elements as for the linkedlist encoding, and each chunk
+// is stored under the element key of its first element, so the chunk holding an element
+// is the closest one at or before its key.
+//
+// The metadata does not keep an index of the chunks, quicklistChunkStart finds the chunk
+// of an element with a single reverse seek from its key instead. An index would have to
+// be rewritten with the metadata on every write which adds or removes a chunk, growing
+// with the list until it takes more than the chunks it saves reading, while the element
+// keys already sort in list order and give the same lookup for free.
+const internalQuicklistType = 'Q'
+
+// List encodings, as reported by OBJECT ENCODING. The linkedlist encoding stores each
+// element under its own key.
+const (
+	listEncodingLinkedList = "linkedlist"
+	listEncodingQuicklist  = "quicklist"
+)
+
+var ErrInvalidListChunk = errors.New("Invalid list chunk")
+
+// listChunkSize bounds the size of quicklist chunks, a larger element gets a chunk of
+// its own. New lists use the quicklist encoding when newListsChunked is set, existing
+// lists keep the encoding they were created with.
+var listChunkSize int64 = 8 * 1024
+var newListsChunked int32
+
+// maxListChunkSize is the largest list-chunk-size, a chunk is written whole on each write
+// to it and several of them can be written by a single transaction
+const maxListChunkSize = 1024 * 1024
+
+func setListEncoding(encoding string, chunkSize int64) {
+	chunked := int32(0)
+	if encoding == listEncodingQuicklist {
+		chunked = 1
+	}
+	if chunkSize > 0 {
+		atomic.StoreInt64(&listChunkSize, chunkSize)
+	}
+	atomic.StoreInt32(&newListsChunked, chunked)
+}
+
+// chunkElementSize is how many bytes value takes in a chunk
+func chunkElementSize(value []byte) int64 {
+	var length [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(length[:], uint64(len(value))) + len(value))
+}
+
+// encodeChunk packs elements as their uvarint length followed by their content
+func encodeChunk(elements [][]byte) []byte {
+	var chunk bytes.Buffer
+	var length [binary.MaxVarintLen64]byte
+	for _, element := range elements {
+		chunk.Write(length[:binary.PutUvarint(length[:], uint64(len(element)))])
+		chunk.Write(element)
+	}
+	return chunk.Bytes()
+}
+
+func decodeChunk(chunk []byte) ([][]byte, error) {
+	elements := [][]byte{}
+	for len(chunk) > 0 {
+		length, n := binary.Uvarint(chunk)
+		if n <= 0 || uint64(len(chunk)-n) < length {
+			return nil, ErrInvalidListChunk
+		}
+		elements = append(elements, chunk[n:n+int(length)])
+		chunk = chunk[n+int(length):]
+	}
+	return elements, nil
+}
+
+// quicklistGetChunk reads the chunk whose first element is at index start, chunks are
+// never empty
+func quicklistGetChunk(txn *badger.Txn, key []byte, start int64) ([][]byte, error) {
+	chunk, err := listGetItem(txn, key, start)
+	if err != nil {
+		return nil, err
+	}
+	elements, err := decodeChunk(chunk)
+	if err == nil && len(elements) == 0 {
+		err = ErrInvalidListChunk
+	}
+	return elements, err
+}
+
+func quicklistSetChunk(txn *badger.Txn, key []byte, start int64, elements [][]byte) error {
+	return txn.Set(listItemKey(key, start), encodeChunk(elements))
+}
+
+// quicklistSplitChunk is quicklistSetChunk for a chunk which got bigger. It is split in
+// halves when it goes over listChunkSize, and the halves again until each of them fits
+// or holds a single element.
+func quicklistSplitChunk(txn *badger.Txn, key []byte, start int64, elements [][]byte) error {
+	chunkBytes := int64(0)
+	for _, element := range elements {
+		chunkBytes += chunkElementSize(element)
+	}
+	if chunkBytes <= atomic.LoadInt64(&listChunkSize) || len(elements) < 2 {
+		return quicklistSetChunk(txn, key, start, elements)
+	}
+	half := len(elements) / 2
+	err := quicklistSplitChunk(txn, key, start, elements[:half])
+	if err != nil {
+		return err
+	}
+	return quicklistSplitChunk(txn, key, start+int64(half), elements[half:])
+}
+
+// quicklistChunkStart returns the index of the first element of the chunk holding the
+// element at index, seeking to it from the element key without reading any chunk
+func quicklistChunkStart(txn *badger.Txn, key []byte, metadata ListMetadata, index int64) (int64, error) {
+	start := int64(0)
+	found := false
+	err := listIterate(txn, key, metadata.first, index, true, false, func(chunkStart int64, item *badger.Item) (bool, error) {
+		start, found = chunkStart, true
+		return false, nil
+	})
+	if err == nil && !found {
+		err = ErrInvalidListChunk
+	}
+	return start, err
+}
+
+// quicklistChunkAt returns the chunk holding the element at index and the index of its
+// first element
+func quicklistChunkAt(txn *badger.Txn, key []byte, metadata ListMetadata, index int64) (int64, [][]byte, error) {
+	start, err := quicklistChunkStart(txn, key, metadata, index)
+	if err != nil {
+		return 0, nil, err
+	}
+	elements, err := quicklistGetChunk(txn, key, start)
+	if err != nil {
+		return 0, nil, err
+	}
+	if index-start >= int64(len(elements)) {
+		return 0, nil, ErrInvalidListChunk
+	}
+	return start, elements, nil
+}
+
+// quicklistMoveChunks moves the chunks starting between from and to, both included, by
+// shift indexes. They are moved starting from the side they move to, so that none
+// overwrites another one.
+func quicklistMoveChunks(txn *badger.Txn, key []byte, from, to, shift int64) error {
+	return listWalk(txn, key, from, to, shift > 0, func(start int64, chunk []byte) (bool, error) {
+		err := txn.Delete(listItemKey(key, start))
+		if err != nil {
+			return false, err
+		}
+		return true, txn.Set(listItemKey(key, start+shift), chunk)
+	})
+}
+
+// quicklistWalk is listWalkElements for the quicklist encoding, only the chunks holding
+// elements between start and end are read
+func quicklistWalk(txn *badger.Txn, key []byte, metadata ListMetadata, start, end int64, reverse bool, fn func(position int64, value []byte) (bool, error)) error {
+	firstChunk, err := quicklistChunkStart(txn, key, metadata, metadata.first+start)
+	if err != nil {
+		return err
+	}
+	return listWalk(txn, key, firstChunk, metadata.first+end, reverse, func(chunkStart int64, chunk []byte) (bool, error) {
+		elements, err := decodeChunk(chunk)
+		if err != nil {
+			return false, err
+		}
+		for i := range elements {
+			offset := i
+			if reverse {
+				offset = len(elements) - 1 - i
+			}
+			position := chunkStart + int64(offset) - metadata.first
+			if position < start || position > end {
+				continue
+			}
+			more, err := fn(position, elements[offset])
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+// quicklistPush adds values to one end of the list the same way listPush does, filling
+// the end chunk before starting a new one
+func quicklistPush(txn *badger.Txn, key []byte, metadata ListMetadata, values [][]byte, direction Direction) (ListMetadata, error) {
+	chunkSize := atomic.LoadInt64(&listChunkSize)
+	left := direction == DirectionLeft
+	// chunk holds the elements of the end chunk, from the end of the list inwards when
+	// pushing to the head so values are appended rather than prepended. chunkStart is the
+	// index of its first element.
+	var chunk [][]byte
+	var chunkBytes int64
+	chunkStart := metadata.last + 1
+	if left {
+		chunkStart = metadata.first
+	}
+	// the head chunk gets a new first element, and so a new key, when pushing to the head
+	relocated := false
+	if metadata.size > 0 {
+		var elements [][]byte
+		var err error
+		if left {
+			elements, err = quicklistGetChunk(txn, key, chunkStart)
+			relocated = true
+		} else {
+			chunkStart, elements, err = quicklistChunkAt(txn, key, metadata, metadata.last)
+		}
+		if err != nil {
+			return metadata, err
+		}
+		for i := range elements {
+			if left {
+				chunk = append(chunk, elements[len(elements)-1-i])
+			} else {
+				chunk = append(chunk, elements[i])
+			}
+			chunkBytes += chunkElementSize(elements[i])
+		}
+	}
+	loadedStart := chunkStart
+
+	store := func() error {
+		if relocated && chunkStart != loadedStart {
+			err := txn.Delete(listItemKey(key, loadedStart))
+			if err != nil {
+				return err
+			}
+		}
+		relocated = false
+		if left {
+			elements := make([][]byte, len(chunk))
+			for i, element := range chunk {
+				elements[len(chunk)-1-i] = element
+			}
+			return quicklistSetChunk(txn, key, chunkStart, elements)
+		}
+		return quicklistSetChunk(txn, key, chunkStart, chunk)
+	}
+	for i := range values {
+		value := values[i]
+		if left {
+			value = values[len(values)-1-i]
+		}
+		size := chunkElementSize(value)
+		if len(chunk) > 0 && chunkBytes+size > chunkSize {
+			err := store()
+			if err != nil {
+				return metadata, err
+			}
+			if !left {
+				chunkStart += int64(len(chunk))
+			}
+			chunk, chunkBytes = nil, 0
+		}
+
+		chunk = append(chunk, value)
+		chunkBytes += size
+		if left {
+			metadata.first--
+			chunkStart = metadata.first
+		} else {
+			metadata.last++
+		}
+		metadata.size++
+	}
+	if len(values) == 0 {
+		return metadata, nil
+	}
+	return metadata, store()
+}
+
+// quicklistCreate creates a list with values, from the head
+func quicklistCreate(txn *badger.Txn, key []byte, values [][]byte) (ListMetadata, error) {
+	metadata := ListMetadata{0, -1, 0, true}
+	metadata, err := quicklistPush(txn, key, metadata, values, DirectionRight)
+	if err != nil {
+		return metadata, err
+	}
+	return metadata, listSetMetadata(txn, key, metadata)
+}
+
+// quicklistPop removes up to count elements from one end of the list, whole chunks are
+// deleted once emptied
+func quicklistPop(txn *badger.Txn, key []byte, metadata ListMetadata, direction Direction, count int64) ([][]byte, ListMetadata, error) {
+	if count > metadata.size {
+		count = metadata.size
+	}
+	values := make([][]byte, 0, count)
+	for count > 0 {
+		start := metadata.first
+		var elements [][]byte
+		var err error
+		if direction == DirectionLeft {
+			elements, err = quicklistGetChunk(txn, key, start)
+		} else {
+			start, elements, err = quicklistChunkAt(txn, key, metadata, metadata.last)
+		}
+		if err != nil {
+			return nil, metadata, err
+		}
+		popped := int64(len(elements))
+		if count < popped {
+			popped = count
+		}
+		for j := int64(0); j < popped; j++ {
+			if direction == DirectionLeft {
+				values = append(values, elements[j])
+			} else {
+				values = append(values, elements[int64(len(elements))-1-j])
+			}
+		}
+
+		if direction == DirectionLeft {
+			// what is left of the chunk starts at the new head
+			err = txn.Delete(listItemKey(key, start))
+			if err == nil && popped < int64(len(elements)) {
+				err = quicklistSetChunk(txn, key, start+popped, elements[popped:])
+			}
+			metadata.first += popped
+		} else {
+			if popped == int64(len(elements)) {
+				err = txn.Delete(listItemKey(key, start))
+			} else {
+				err = quicklistSetChunk(txn, key, start, elements[:int64(len(elements))-popped])
+			}
+			metadata.last -= popped
+		}
+		if err != nil {
+			return nil, metadata, err
+		}
+		metadata.size -= popped
+		count -= popped
+	}
+	return values, metadata, listSetMetadata(txn, key, metadata)
+}
+
+// quicklistIndex returns the element at position, counted from the head
+func quicklistIndex(txn *badger.Txn, key []byte, metadata ListMetadata, position int64) ([]byte, error) {
+	index := metadata.first + position
+	start, elements, err := quicklistChunkAt(txn, key, metadata, index)
+	if err != nil {
+		return nil, err
+	}
+	return elements[index-start], nil
+}
+
+// quicklistSet replaces the element at position, a chunk which gets too big is split
+func quicklistSet(txn *badger.Txn, key []byte, metadata ListMetadata, position int64, value []byte) error {
+	index := metadata.first + position
+	start, elements, err := quicklistChunkAt(txn, key, metadata, index)
+	if err != nil {
+		return err
+	}
+	elements[index-start] = value
+	return quicklistSplitChunk(txn, key, start, elements)
+}
+
+// quicklistInsert inserts value at position in its chunk. The chunks between it and the
+// closest end of the list are moved by one index to make room, a chunk which gets too
+// big is split in two.
+func quicklistInsert(txn *badger.Txn, key []byte, metadata ListMetadata, position int64, value []byte) (ListMetadata, error) {
+	left := position < metadata.size-position
+	direction := DirectionRight
+	if left {
+		direction = DirectionLeft
+	}
+	err := metadata.checkGrowth(1, direction)
+	if err != nil {
+		return metadata, err
+	}
+	index := metadata.first + position
+	// an element inserted after the tail goes to the end of the tail chunk
+	at := index
+	if position == metadata.size {
+		at = metadata.last
+	}
+	start, elements, err := quicklistChunkAt(txn, key, metadata, at)
+	if err != nil {
+		return metadata, err
+	}
+	offset := index - start
+	elements = append(elements[:offset:offset], append([][]byte{value}, elements[offset:]...)...)
+
+	if left {
+		// the elements before the insertion point move to the left
+		err = quicklistMoveChunks(txn, key, metadata.first, start-1, -1)
+		if err == nil {
+			err = txn.Delete(listItemKey(key, start))
+		}
+		start--
+		metadata.first--
+	} else {
+		// the elements after it move to the right
+		err = quicklistMoveChunks(txn, key, start+1, metadata.last, 1)
+		metadata.last++
+	}
+	if err != nil {
+		return metadata, err
+	}
+	metadata.size++
+	return metadata, quicklistSplitChunk(txn, key, start, elements)
+}
+
+// quicklistRemove is listRemove for the quicklist encoding. The chunks holding elements
+// to remove are found first, with how many of their elements are removed, then they are
+// written again and the chunks on the shorter side of them are moved to fill the gaps.
+func quicklistRemove(txn *badger.Txn, key []byte, metadata ListMetadata, value []byte, reverse bool, limit int64) (int64, ListMetadata, error) {
+	var removedCount int64
+	starts, counts := []int64{}, []int64{}
+	err := listWalk(txn, key, metadata.first, metadata.last, reverse, func(start int64, chunk []byte) (bool, error) {
+		elements, err := decodeChunk(chunk)
+		if err != nil {
+			return false, err
+		}
+		var matches int64
+		for _, element := range elements {
+			if limit != 0 && removedCount+matches == limit {
+				break
+			}
+			if bytes.Equal(element, value) {
+				matches++
+			}
+		}
+		if matches > 0 {
+			starts = append(starts, start)
+			counts = append(counts, matches)
+			removedCount += matches
+		}
+		return limit == 0 || removedCount < limit, nil
+	})
+	if err != nil || removedCount == 0 {
+		return 0, metadata, err
+	}
+	if reverse {
+		reverseIndexes(starts)
+		reverseIndexes(counts)
+	}
+
+	// kept drops removed matches from elements, the first ones or the last ones when
+	// removing from the tail
+	kept := func(elements [][]byte, removed int64) [][]byte {
+		dropped := make([]bool, len(elements))
+		for i := range elements {
+			if removed == 0 {
+				break
+			}
+			offset := i
+			if reverse {
+				offset = len(elements) - 1 - i
+			}
+			if bytes.Equal(elements[offset], value) {
+				dropped[offset] = true
+				removed--
+			}
+		}
+		result := make([][]byte, 0, len(elements))
+		for i, element := range elements {
+			if !dropped[i] {
+				result = append(result, element)
+			}
+		}
+		return result
+	}
+	// rewrite stores what is left of the chunk at start under its new first index
+	rewrite := func(start, newStart int64, elements [][]byte) error {
+		if newStart != start || len(elements) == 0 {
+			err := txn.Delete(listItemKey(key, start))
+			if err != nil || len(elements) == 0 {
+				return err
+			}
+		}
+		return quicklistSetChunk(txn, key, newStart, elements)
+	}
+
+	var shift int64
+	if starts[len(starts)-1]-metadata.first < metadata.last-starts[0] {
+		// move the chunks before the last one with removed elements to the right
+		next := len(starts) - 1
+		err = listWalk(txn, key, metadata.first, starts[len(starts)-1], true, func(start int64, chunk []byte) (bool, error) {
+			elements, err := decodeChunk(chunk)
+			if err != nil {
+				return false, err
+			}
+			if next >= 0 && start == starts[next] {
+				shift += counts[next]
+				elements = kept(elements, counts[next])
+				next--
+			} else if shift == 0 {
+				return true, nil
+			}
+			return true, rewrite(start, start+shift, elements)
+		})
+		metadata.first += removedCount
+	} else {
+		// move the chunks after the first one with removed elements to the left
+		next := 0
+		err = listWalk(txn, key, starts[0], metadata.last, false, func(start int64, chunk []byte) (bool, error) {
+			elements, err := decodeChunk(chunk)
+			if err != nil {
+				return false, err
+			}
+			newStart := start - shift
+			if next < len(starts) && start == starts[next] {
+				shift += counts[next]
+				elements = kept(elements, counts[next])
+				next++
+			} else if shift == 0 {
+				return true, nil
+			}
+			return true, rewrite(start, newStart, elements)
+		})
+		metadata.last -= removedCount
+	}
+	if err != nil {
+		return 0, metadata, err
+	}
+	metadata.size -= removedCount
+	return removedCount, metadata, nil
+}
+
+// quicklistTrim keeps the elements between positions start and end, both included.
+// The chunks outside of the range are deleted, the ones it starts and ends in are cut.
+func quicklistTrim(txn *badger.Txn, key []byte, metadata ListMetadata, start, end int64) error {
+	first, last := metadata.first+start, metadata.first+end
+	headStart, head, err := quicklistChunkAt(txn, key, metadata, first)
+	if err != nil {
+		return err
+	}
+	tailStart, tail, err := quicklistChunkAt(txn, key, metadata, last)
+	if err != nil {
+		return err
+	}
+	deleteChunk := func(chunkStart int64, item *badger.Item) (bool, error) {
+		return true, txn.Delete(listItemKey(key, chunkStart))
+	}
+	err = listIterate(txn, key, metadata.first, headStart-1, false, false, deleteChunk)
+	if err != nil {
+		return err
+	}
+	err = listIterate(txn, key, tailStart+1, metadata.last, false, false, deleteChunk)
+	if err != nil {
+		return err
+	}
+
+	if headStart == tailStart {
+		head = head[:last-headStart+1]
+	} else if last-tailStart+1 < int64(len(tail)) {
+		err = quicklistSetChunk(txn, key, tailStart, tail[:last-tailStart+1])
+		if err != nil {
+			return err
+		}
+	}
+	if first != headStart || headStart == tailStart {
+		// the head chunk starts at the first element kept
+		err = txn.Delete(listItemKey(key, headStart))
+		if err != nil {
+			return err
+		}
+		err = quicklistSetChunk(txn, key, first, head[first-headStart:])
+		if err != nil {
+			return err
+		}
+	}
+
+	metadata.first, metadata.last, metadata.size = first, last, end-start+1
+	return listSetMetadata(txn, key, metadata)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var ErrUnsupportedReply = errors.New("Unsupported reply type")
+
+// Handlers return their reply as a plain value which is encoded according to the
+// protocol version the connection negotiated with HELLO:
+//
+//	nil                     null ($-1 in RESP2, _ in RESP3)
+//	int, int64, uint32, ... integer
+//	string                  simple string
+//	[]byte                  bulk string
+//	error                   error
+//	bool                    boolean (1 or 0 in RESP2)
+//	float64                 double (bulk string in RESP2)
+//	[]interface{}, [][]byte array
+//	respMap, respSet, respPush, respVerbatim and respNullArray below
+type (
+	// respMap is an ordered map, sent as a flat array of keys and values in RESP2
+	respMap []respMapEntry
+	// respSet is an unordered collection, sent as an array in RESP2
+	respSet []interface{}
+	// respPush is an out of band message like pub/sub messages, sent as an array in RESP2
+	respPush []interface{}
+	// respVerbatim is a text to be shown as is, format is a three letters type like txt
+	// or mkd. It is sent as a bulk string in RESP2.
+	respVerbatim struct {
+		format string
+		text   []byte
+	}
+	// respNullArray is a null array ($-1 in RESP2, _ in RESP3) for commands that reply
+	// with an array when they succeed, like BLPOP
+	respNullArray struct{}
+	// noReplyType tells the dispatcher not to send anything, see noReply
+	noReplyType struct{}
+)
+
+type respMapEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// noReply is returned by handlers that do not reply, like SHUTDOWN
+var noReply = noReplyType{}
+
+func appendLength(buf []byte, prefix byte, length int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(length), 10)
+	return append(buf, '\r', '\n')
+}
+
+func appendBulk(buf []byte, value []byte) []byte {
+	buf = appendLength(buf, '$', len(value))
+	buf = append(buf, value...)
+	return append(buf, '\r', '\n')
+}
+
+// bulkSize is how many bytes appendBulk adds for value
+func bulkSize(value []byte) int64 {
+	var length [20]byte
+	return int64(len(strconv.AppendInt(length[:0], int64(len(value)), 10)) + len(value) + 5)
+}
+
+func appendInteger(buf []byte, value int64) []byte {
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, value, 10)
+	return append(buf, '\r', '\n')
+}
+
+func formatDouble(value float64) []byte {
+	switch {
+	case math.IsInf(value, 1):
+		return []byte("inf")
+	case math.IsInf(value, -1):
+		return []byte("-inf")
+	case math.IsNaN(value):
+		return []byte("nan")
+	}
+	return strconv.AppendFloat(nil, value, 'g', -1, 64)
+}
+
+// appendReply encodes value for a connection using the given protocol version, 2 or 3
+func appendReply(buf []byte, value interface{}, proto int) ([]byte, error) {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		if proto >= 3 {
+			return append(buf, '_', '\r', '\n'), nil
+		}
+		return append(buf, '$', '-', '1', '\r', '\n'), nil
+	case respNullArray:
+		if proto >= 3 {
+			return append(buf, '_', '\r', '\n'), nil
+		}
+		return append(buf, '*', '-', '1', '\r', '\n'), nil
+	case int:
+		return appendInteger(buf, int64(v)), nil
+	case int8:
+		return appendInteger(buf, int64(v)), nil
+	case int16:
+		return appendInteger(buf, int64(v)), nil
+	case int32:
+		return appendInteger(buf, int64(v)), nil
+	case int64:
+		return appendInteger(buf, v), nil
+	case uint8:
+		return appendInteger(buf, int64(v)), nil
+	case uint16:
+		return appendInteger(buf, int64(v)), nil
+	case uint32:
+		return appendInteger(buf, int64(v)), nil
+	case uint64:
+		buf = append(buf, ':')
+		buf = strconv.AppendUint(buf, v, 10)
+		return append(buf, '\r', '\n'), nil
+	case bool:
+		if proto >= 3 {
+			if v {
+				return append(buf, '#', 't', '\r', '\n'), nil
+			}
+			return append(buf, '#', 'f', '\r', '\n'), nil
+		}
+		if v {
+			return appendInteger(buf, 1), nil
+		}
+		return appendInteger(buf, 0), nil
+	case float64:
+		if proto >= 3 {
+			buf = append(buf, ',')
+			buf = append(buf, formatDouble(v)...)
+			return append(buf, '\r', '\n'), nil
+		}
+		return appendBulk(buf, formatDouble(v)), nil
+	case string:
+		buf = append(buf, '+')
+		buf = append(buf, v...)
+		return append(buf, '\r', '\n'), nil
+	case []byte:
+		return appendBulk(buf, v), nil
+	case error:
+		buf = append(buf, '-')
+		// errors can quote client input, which must not end the reply early
+		for _, char := range []byte(errorReply(v).Error()) {
+			if char == '\r' || char == '\n' {
+				char = ' '
+			}
+			buf = append(buf, char)
+		}
+		return append(buf, '\r', '\n'), nil
+	case respVerbatim:
+		if proto >= 3 {
+			buf = appendLength(buf, '=', len(v.format)+1+len(v.text))
+			buf = append(buf, v.format...)
+			buf = append(buf, ':')
+			buf = append(buf, v.text...)
+			return append(buf, '\r', '\n'), nil
+		}
+		return appendBulk(buf, v.text), nil
+	case [][]byte:
+		buf = appendLength(buf, '*', len(v))
+		for _, element := range v {
+			buf = appendBulk(buf, element)
+		}
+		return buf, nil
+	case []interface{}:
+		return appendAggregate(buf, '*', v, proto)
+	case respSet:
+		prefix := byte('*')
+		if proto >= 3 {
+			prefix = '~'
+		}
+		return appendAggregate(buf, prefix, v, proto)
+	case respPush:
+		prefix := byte('*')
+		if proto >= 3 {
+			prefix = '>'
+		}
+		return appendAggregate(buf, prefix, v, proto)
+	case respMap:
+		if proto >= 3 {
+			buf = appendLength(buf, '%', len(v))
+		} else {
+			buf = appendLength(buf, '*', len(v)*2)
+		}
+		for _, entry := range v {
+			buf, err = appendReply(buf, entry.key, proto)
+			if err != nil {
+				return nil, err
+			}
+			buf, err = appendReply(buf, entry.value, proto)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, ErrUnsupportedReply
+	}
+}
+
+func appendAggregate(buf []byte, prefix byte, elements []interface{}, proto int) ([]byte, error) {
+	var err error
+	buf = appendLength(buf, prefix, len(elements))
+	for _, element := range elements {
+		buf, err = appendReply(buf, element, proto)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
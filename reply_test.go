@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAppendReply(t *testing.T) {
+	testCases := []struct {
+		title  string
+		value  interface{}
+		proto2 string
+		proto3 string
+	}{
+		{"nil", nil, "$-1\r\n", "_\r\n"},
+		{"null array", respNullArray{}, "*-1\r\n", "_\r\n"},
+		{"integer", int64(-42), ":-42\r\n", ":-42\r\n"},
+		{"simple string", "OK", "+OK\r\n", "+OK\r\n"},
+		{"bulk string", []byte("a\r\nb"), "$4\r\na\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+		{"error", errors.New("NOPROTO unsupported protocol version"), "-NOPROTO unsupported protocol version\r\n", "-NOPROTO unsupported protocol version\r\n"},
+		{"error without code", errors.New("no such key"), "-ERR no such key\r\n", "-ERR no such key\r\n"},
+		{"error with line breaks", errors.New("ERR unknown command `a\r\n+OK`"), "-ERR unknown command `a  +OK`\r\n", "-ERR unknown command `a  +OK`\r\n"},
+		{"true", true, ":1\r\n", "#t\r\n"},
+		{"false", false, ":0\r\n", "#f\r\n"},
+		{"double", 1.5, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"infinite double", math.Inf(-1), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"array", []interface{}{int64(1), nil}, "*2\r\n:1\r\n$-1\r\n", "*2\r\n:1\r\n_\r\n"},
+		{"bulk string array", [][]byte{[]byte("a"), []byte("bc")}, "*2\r\n$1\r\na\r\n$2\r\nbc\r\n", "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{"map", respMap{{"proto", 3}, {"modules", []interface{}{}}}, "*4\r\n+proto\r\n:3\r\n+modules\r\n*0\r\n", "%2\r\n+proto\r\n:3\r\n+modules\r\n*0\r\n"},
+		{"set", respSet{"a", true}, "*2\r\n+a\r\n:1\r\n", "~2\r\n+a\r\n#t\r\n"},
+		{"verbatim", respVerbatim{"txt", []byte("id=1")}, "$4\r\nid=1\r\n", "=8\r\ntxt:id=1\r\n"},
+		{"push", respPush{[]byte("message"), []byte("ch"), []byte("hi")}, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		for proto, expected := range map[int]string{2: testCase.proto2, 3: testCase.proto3} {
+			reply, err := appendReply(nil, testCase.value, proto)
+			if err != nil || string(reply) != expected {
+				t.Fatalf("Case \"%s\" with RESP%d:\n Expected reply=%q\n Actual reply=%q, err=%v", testCase.title, proto, expected, reply, err)
+			}
+		}
+	}
+
+	_, err := appendReply(nil, struct{}{}, 3)
+	if err != ErrUnsupportedReply {
+		t.Fatalf("Case \"unsupported type\":\n Expected err=%v\n Actual err=%v", ErrUnsupportedReply, err)
+	}
+}
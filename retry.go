@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	badger "github.com/dgraph-io/badger/v2"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTooManyConflicts = errors.New("ERR too many concurrent writes to the same keys, try again")
+
+const (
+	// maxConflictRetries is how many times a write which conflicts with a concurrent
+	// one is retried before giving up
+	maxConflictRetries = 10
+	// minConflictBackoff is the wait before the first retry, it doubles with each retry
+	// up to maxConflictBackoff. The actual wait is randomized so the conflicting
+	// writers do not retry in lockstep.
+	minConflictBackoff = 500 * time.Microsecond
+	maxConflictBackoff = 50 * time.Millisecond
+)
+
+// conflictStats are shown in INFO stats
+var conflictStats struct {
+	// conflicts is how many times a write failed because of a concurrent one
+	conflicts int64
+	// retries is how many of them were retried
+	retries int64
+	// failures is how many writes gave up after maxConflictRetries
+	failures int64
+}
+
+// retryConflicts runs fn until it does not fail with badger.ErrConflict, fn must start
+// a new transaction each time
+func retryConflicts(fn func() error) error {
+	backoff := minConflictBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err != badger.ErrConflict {
+			return err
+		}
+		atomic.AddInt64(&conflictStats.conflicts, 1)
+		if attempt == maxConflictRetries {
+			atomic.AddInt64(&conflictStats.failures, 1)
+			return ErrTooManyConflicts
+		}
+
+		atomic.AddInt64(&conflictStats.retries, 1)
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		backoff *= 2
+		if backoff > maxConflictBackoff {
+			backoff = maxConflictBackoff
+		}
+	}
+}
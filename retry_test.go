@@ -0,0 +1,102 @@
+package main
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryConflicts(t *testing.T) {
+	testCases := []struct {
+		title     string
+		conflicts int
+		calls     int
+		err       error
+	}{
+		{"no conflict", 0, 1, nil},
+		{"a few conflicts", 3, 4, nil},
+		{"too many conflicts", maxConflictRetries + 5, maxConflictRetries + 1, ErrTooManyConflicts},
+	}
+
+	for _, testCase := range testCases {
+		calls := 0
+		err := retryConflicts(func() error {
+			calls++
+			if calls <= testCase.conflicts {
+				return badger.ErrConflict
+			}
+			return nil
+		})
+		if err != testCase.err || calls != testCase.calls {
+			t.Fatalf("Case \"%s\":\n Expected err=%v, calls=%d\n Actual err=%v, calls=%d", testCase.title, testCase.err, testCase.calls, err, calls)
+		}
+	}
+}
+
+// TestConcurrentListWrites pushes to and pops from the same list from many clients at
+// once, none of them should see a conflict and no element should be lost
+func TestConcurrentListWrites(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const clients = 10
+	const pushes = 50
+	// every client pops once every popEvery pushes
+	const popEvery = 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*pushes*2)
+	popped := make(chan []byte, clients*pushes)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := newClient(nil)
+			for j := 0; j < pushes; j++ {
+				_, err := dispatch(c, [][]byte{[]byte("RPUSH"), []byte("hammered"), []byte(strconv.Itoa(i*pushes + j))})
+				if err != nil {
+					errs <- err
+				}
+				if j%popEvery != 0 {
+					continue
+				}
+				value, err := dispatch(c, [][]byte{[]byte("LPOP"), []byte("hammered")})
+				if err != nil {
+					errs <- err
+				} else if value != nil {
+					popped <- value.([]byte)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(popped)
+
+	for err := range errs {
+		t.Fatalf("Expected no error, Actual %v", err)
+	}
+
+	seen := map[string]bool{}
+	for value := range popped {
+		seen[string(value)] = true
+	}
+	remaining, err := dispatch(newClient(nil), [][]byte{[]byte("LRANGE"), []byte("hammered"), []byte("0"), []byte("-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range remaining.([][]byte) {
+		if seen[string(value)] {
+			t.Fatalf("Expected %s to be either popped or in the list, Actual both", value)
+		}
+		seen[string(value)] = true
+	}
+	if len(seen) != clients*pushes {
+		t.Fatalf("Expected %d distinct elements, Actual %d", clients*pushes, len(seen))
+	}
+	t.Logf("%d conflicts, %d retries", atomic.LoadInt64(&conflictStats.conflicts), atomic.LoadInt64(&conflictStats.retries))
+}
@@ -1,24 +1,76 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
-	"github.com/0xc0d3d00d/goresp"
 	badger "github.com/dgraph-io/badger/v2"
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"os"
+	"os/signal"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const internalKeyPrefix = "$$$_"
 
+// serverVersion is the redis version reported to clients, they use it to decide which
+// commands and options they can send
+const serverVersion = "6.73"
+
 var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 var ErrIndexOutOfRange = errors.New("ERR index out of range")
+var ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+var ErrSyntax = errors.New("ERR syntax error")
+var ErrReplyTooLarge = errors.New("ERR reply is larger than max-reply-size")
+var ErrInternal = errors.New("ERR internal error")
+var ErrUnsupportedProtocol = errors.New("NOPROTO unsupported protocol version")
+var ErrWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+var ErrMaxClients = errors.New("ERR max number of clients reached")
+var ErrShuttingDown = errors.New("Server is shutting down")
+var ErrInvalidClientName = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+var ErrNotAllowedInMulti = errors.New("ERR Command not allowed inside a transaction")
+
+// errorCodes are the error prefixes redis clients know about, any other error is sent
+// with the generic ERR prefix
+var errorCodes = map[string]bool{
+	"ERR":       true,
+	"WRONGTYPE": true,
+	"NOAUTH":    true,
+	"NOPERM":    true,
+	"WRONGPASS": true,
+	"EXECABORT": true,
+	"NOPROTO":   true,
+	"BUSYKEY":   true,
+	"NOSCRIPT":  true,
+	"LOADING":   true,
+	"READONLY":  true,
+	"OOM":       true,
+}
+
+// errorReply prefixes err with ERR unless it already starts with a known error code
+func errorReply(err error) error {
+	msg := err.Error()
+	code := msg
+	if space := strings.IndexByte(msg, ' '); space >= 0 {
+		code = msg[:space]
+	}
+	if errorCodes[code] {
+		return err
+	}
+	return errors.New("ERR " + msg)
+}
 
-type commandHandler func([]interface{}) ([]byte, error)
+type commandHandler func(c *client, args [][]byte) (interface{}, error)
 
 func UnmarshalMetadata(data []byte) (interface{}, error) {
 	if len(data) == 0 {
@@ -27,163 +79,587 @@ func UnmarshalMetadata(data []byte) (interface{}, error) {
 
 	metaType := data[0]
 	switch metaType {
-	case internalListType:
+	case internalListType, internalQuicklistType:
 		return UnmarshalListMetadata(data)
 	default:
 		return nil, errors.New("Unsupported metadata type")
 	}
 }
 
-func lindex(args []interface{}) ([]byte, error) {
-	if len(args) != 3 {
-		return nil, errors.New("ERR wrong number of arguments for 'lindex' command")
+func lindex(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	indexStr := string(args[2])
+	index, err := strconv.ParseInt(indexStr, 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
 	}
 
-	key := args[1].([]byte)
-	indexStr := string(args[2].([]byte))
+	var result []byte
+	var found bool
+	err = view(c, func(txn *badger.Txn) error {
+		result, found, err = listIndex(txn, key, index)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return result, nil
+}
+
+func lset(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	indexStr := string(args[2])
 	index, err := strconv.ParseInt(indexStr, 10, 64)
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, ErrNotInteger
 	}
+	value := args[3]
 
-	result, err := listIndex(key, index)
+	err = update(c, func(txn *badger.Txn) error {
+		return listSet(txn, key, value, index)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if len(result) == 0 {
-		return goresp.Marshal(nil)
-	}
+	notifyKeyspaceEvent(c, notifyList, "lset", key)
+	return "OK", nil
+}
 
-	return goresp.Marshal(result)
+func lpush(c *client, args [][]byte) (interface{}, error) {
+	values := [][]byte{}
+	for i := 2; i < len(args); i++ {
+		values = append(values, args[i])
+	}
+	var size int64
+	err := update(c, func(txn *badger.Txn) error {
+		var err error
+		size, err = listPush(txn, args[1], values, DirectionLeft)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	notifyKeyspaceEvent(c, notifyList, "lpush", args[1])
+	return size, nil
 }
 
-func lset(args []interface{}) ([]byte, error) {
-	if len(args) != 4 {
-		return nil, errors.New("ERR wrong number of arguments for 'lset' command")
+func rpush(c *client, args [][]byte) (interface{}, error) {
+	values := [][]byte{}
+	for i := 2; i < len(args); i++ {
+		values = append(values, args[i])
 	}
-	key := args[1].([]byte)
-	indexStr := string(args[2].([]byte))
-	index, err := strconv.ParseInt(indexStr, 10, 64)
+	var size int64
+	err := update(c, func(txn *badger.Txn) error {
+		var err error
+		size, err = listPush(txn, args[1], values, DirectionRight)
+		return err
+	})
 	if err != nil {
-		return nil, errors.New("ERR value is not an integer or out of range")
+		return nil, err
 	}
-	value := args[3].([]byte)
+	notifyKeyspaceEvent(c, notifyList, "rpush", args[1])
+	return size, nil
+}
 
-	err = listSet(key, value, index)
+// pushExisting implements LPUSHX and RPUSHX, nothing is pushed when the list does not
+// exist
+func pushExisting(c *client, args [][]byte, direction Direction) (interface{}, error) {
+	var size int64
+	err := update(c, func(txn *badger.Txn) error {
+		var err error
+		size, err = listLength(txn, args[1])
+		if err != nil || size == 0 {
+			return err
+		}
+		size, err = listPush(txn, args[1], args[2:], direction)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	if size > 0 {
+		event := "lpush"
+		if direction == DirectionRight {
+			event = "rpush"
+		}
+		notifyKeyspaceEvent(c, notifyList, event, args[1])
+	}
+	return size, nil
+}
 
-	return goresp.Marshal("OK")
+func lpushx(c *client, args [][]byte) (interface{}, error) {
+	return pushExisting(c, args, DirectionLeft)
 }
 
-func lpush(args []interface{}) ([]byte, error) {
-	if len(args) < 3 {
-		return nil, errors.New("ERR Invalid argument")
-	}
+func rpushx(c *client, args [][]byte) (interface{}, error) {
+	return pushExisting(c, args, DirectionRight)
+}
 
-	values := [][]byte{}
-	for i := 2; i < len(args); i++ {
-		values = append(values, args[i].([]byte))
+func linsert(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	var before bool
+	switch strings.ToUpper(string(args[2])) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return nil, ErrSyntax
 	}
-	size, err := listPush(args[1].([]byte), values, DirectionLeft)
+
+	var size int64
+	err := update(c, func(txn *badger.Txn) error {
+		var err error
+		size, err = listInsert(txn, key, args[3], args[4], before)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return goresp.Marshal(size)
+	if size > 0 {
+		notifyKeyspaceEvent(c, notifyList, "linsert", key)
+	}
+	return size, nil
 }
 
-func rpush(args []interface{}) ([]byte, error) {
-	if len(args) < 3 {
-		return nil, errors.New("ERR Invalid argument")
+func lrem(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	count, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
 	}
 
-	values := [][]byte{}
-	for i := 2; i < len(args); i++ {
-		values = append(values, args[i].([]byte))
-	}
-	size, err := listPush(args[1].([]byte), values, DirectionRight)
+	var removed int64
+	var size int64
+	err = update(c, func(txn *badger.Txn) error {
+		var err error
+		removed, err = listRemove(txn, key, args[3], count)
+		if err != nil || removed == 0 {
+			return err
+		}
+		size, err = listLength(txn, key)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return goresp.Marshal(size)
+	if removed > 0 {
+		notifyKeyspaceEvent(c, notifyList, "lrem", key)
+		if size == 0 {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+		}
+	}
+	return removed, nil
 }
 
-func lpop(args []interface{}) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("ERR wrong number of arguments for 'lpop' command")
+func ltrim(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	start, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	end, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
 	}
 
-	key := args[1].([]byte)
-	value, err := listPop(key, DirectionLeft)
+	var before, after int64
+	err = update(c, func(txn *badger.Txn) error {
+		var err error
+		before, err = listLength(txn, key)
+		if err != nil || before == 0 {
+			return err
+		}
+		err = listTrim(txn, key, start, end)
+		if err != nil {
+			return err
+		}
+		after, err = listLength(txn, key)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return goresp.Marshal(value)
+	if before > 0 {
+		notifyKeyspaceEvent(c, notifyList, "ltrim", key)
+		if after == 0 {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+		}
+	}
+	return "OK", nil
+}
+
+// parseDirection parses the LEFT or RIGHT argument of LMOVE and BLMOVE
+func parseDirection(arg []byte) (Direction, error) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return DirectionLeft, nil
+	case "RIGHT":
+		return DirectionRight, nil
+	}
+	return DirectionUnknown, ErrSyntax
 }
 
-func rpop(args []interface{}) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("ERR wrong number of arguments for 'lpop' command")
+// moveElement implements RPOPLPUSH, LMOVE and their blocking variants, which wait for
+// source to have an element when block is set
+func moveElement(c *client, source, destination []byte, from, to Direction, block bool, timeout time.Duration) (interface{}, error) {
+	var size int64
+	move := func(txn *badger.Txn) (interface{}, error) {
+		value, found, err := listMove(txn, source, destination, from, to)
+		if err != nil || !found {
+			return nil, err
+		}
+		size, err = listLength(txn, source)
+		return value, err
+	}
+
+	var reply interface{}
+	var err error
+	if block {
+		reply, err = blockingPop(c, [][]byte{source}, timeout, nil, move)
+	} else {
+		err = update(c, func(txn *badger.Txn) error {
+			var err error
+			reply, err = move(txn)
+			return err
+		})
+	}
+	if _, ok := reply.([]byte); !ok || err != nil {
+		return reply, err
+	}
+
+	popEvent, pushEvent := "lpop", "lpush"
+	if from == DirectionRight {
+		popEvent = "rpop"
 	}
+	if to == DirectionRight {
+		pushEvent = "rpush"
+	}
+	notifyKeyspaceEvent(c, notifyList, popEvent, source)
+	if size == 0 {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", source)
+	}
+	notifyKeyspaceEvent(c, notifyList, pushEvent, destination)
+	return reply, nil
+}
 
-	key := args[1].([]byte)
-	value, err := listPop(key, DirectionRight)
+func rpoplpush(c *client, args [][]byte) (interface{}, error) {
+	return moveElement(c, args[1], args[2], DirectionRight, DirectionLeft, false, 0)
+}
+
+func lmove(c *client, args [][]byte) (interface{}, error) {
+	from, err := parseDirection(args[3])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseDirection(args[4])
 	if err != nil {
 		return nil, err
 	}
-	return goresp.Marshal(value)
+	return moveElement(c, args[1], args[2], from, to, false, 0)
 }
 
-func llen(args []interface{}) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("ERR wrong number of arguments for 'llen' command")
+var ErrNotPositive = errors.New("ERR value is out of range, must be positive")
+
+// pop implements LPOP and RPOP, an element is replied without a count and an array of
+// up to count elements with one
+func pop(c *client, args [][]byte, direction Direction) (interface{}, error) {
+	key := args[1]
+	if len(args) > 3 {
+		return nil, ErrSyntax
+	}
+	count := int64(1)
+	if len(args) == 3 {
+		var err error
+		count, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || count < 0 {
+			return nil, ErrNotPositive
+		}
 	}
 
-	key := args[1].([]byte)
-	value, err := listLength(key)
+	var values [][]byte
+	var size int64
+	err := update(c, func(txn *badger.Txn) error {
+		var err error
+		values, err = listPopCount(txn, key, direction, count)
+		if err != nil || len(values) == 0 {
+			return err
+		}
+		size, err = listLength(txn, key)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return goresp.Marshal(value)
+
+	if len(values) > 0 {
+		event := "lpop"
+		if direction == DirectionRight {
+			event = "rpop"
+		}
+		notifyKeyspaceEvent(c, notifyList, event, key)
+		if size == 0 {
+			notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+		}
+	}
+	if len(args) == 2 {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	}
+	if values == nil {
+		return respNullArray{}, nil
+	}
+	return values, nil
+}
+
+func lpop(c *client, args [][]byte) (interface{}, error) {
+	return pop(c, args, DirectionLeft)
+}
+
+func rpop(c *client, args [][]byte) (interface{}, error) {
+	return pop(c, args, DirectionRight)
+}
+
+// numKeysArgs returns the keys of commands like LMPOP whose argument at position
+// numKeysPos is the number of keys following it, nil if that number is invalid
+func numKeysArgs(args [][]byte, numKeysPos int) [][]byte {
+	if numKeysPos >= len(args) {
+		return nil
+	}
+	numKeys, err := strconv.ParseInt(string(args[numKeysPos]), 10, 64)
+	if err != nil || numKeys <= 0 || numKeys > int64(len(args)-numKeysPos-1) {
+		return nil
+	}
+	return args[numKeysPos+1 : numKeysPos+1+int(numKeys)]
 }
 
-func lrange(args []interface{}) ([]byte, error) {
-	if len(args) != 4 {
-		return nil, errors.New("ERR wrong number of arguments for 'lrange' command")
+// parseMultiPop parses the `numkeys key [key ...] LEFT|RIGHT [COUNT count]` arguments
+// of LMPOP and BLMPOP
+func parseMultiPop(args [][]byte) ([][]byte, Direction, int64, error) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || numKeys <= 0 {
+		return nil, DirectionUnknown, 0, errors.New("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, DirectionUnknown, 0, ErrSyntax
+	}
+	keys := args[1 : 1+numKeys]
+	direction, err := parseDirection(args[1+numKeys])
+	if err != nil {
+		return nil, DirectionUnknown, 0, err
 	}
 
-	key := args[1].([]byte)
+	count := int64(1)
+	options := args[2+numKeys:]
+	if len(options) == 2 && strings.ToUpper(string(options[0])) == "COUNT" {
+		count, err = strconv.ParseInt(string(options[1]), 10, 64)
+		if err != nil || count <= 0 {
+			return nil, DirectionUnknown, 0, errors.New("ERR count should be greater than 0")
+		}
+	} else if len(options) != 0 {
+		return nil, DirectionUnknown, 0, ErrSyntax
+	}
+	return keys, direction, count, nil
+}
 
-	startStr := string(args[2].([]byte))
-	start, err := strconv.ParseInt(startStr, 10, 64)
+// multiPop implements LMPOP and BLMPOP, it pops up to count elements from the first
+// non-empty list and replies with its key and the elements
+func multiPop(c *client, keys [][]byte, direction Direction, count int64, block bool, timeout time.Duration) (interface{}, error) {
+	var key []byte
+	var size int64
+	pop := func(txn *badger.Txn) (interface{}, error) {
+		for _, key = range keys {
+			values, err := listPopCount(txn, key, direction, count)
+			if err != nil {
+				return nil, err
+			}
+			if len(values) > 0 {
+				size, err = listLength(txn, key)
+				return []interface{}{key, values}, err
+			}
+		}
+		return nil, nil
+	}
+
+	var reply interface{}
+	var err error
+	if block {
+		reply, err = blockingPop(c, keys, timeout, respNullArray{}, pop)
+	} else {
+		err = update(c, func(txn *badger.Txn) error {
+			var err error
+			reply, err = pop(txn)
+			return err
+		})
+	}
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := reply.([]interface{}); !ok {
+		if reply == nil {
+			return respNullArray{}, nil
+		}
+		return reply, nil
+	}
 
-	endStr := string(args[3].([]byte))
-	end, err := strconv.ParseInt(endStr, 10, 64)
+	event := "lpop"
+	if direction == DirectionRight {
+		event = "rpop"
+	}
+	notifyKeyspaceEvent(c, notifyList, event, key)
+	if size == 0 {
+		notifyKeyspaceEvent(c, notifyGeneric, "del", key)
+	}
+	return reply, nil
+}
+
+func lmpop(c *client, args [][]byte) (interface{}, error) {
+	keys, direction, count, err := parseMultiPop(args[1:])
 	if err != nil {
 		return nil, err
 	}
+	return multiPop(c, keys, direction, count, false, 0)
+}
+
+// lpos implements LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len], the
+// position of the match is replied without COUNT and an array of positions with it
+func lpos(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	rank, count, maxLen := int64(1), int64(-1), int64(0)
+	for i := 3; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+		value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if value == 0 {
+				return nil, errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = value
+		case "COUNT":
+			if value < 0 {
+				return nil, errors.New("ERR COUNT can't be negative")
+			}
+			count = value
+		case "MAXLEN":
+			if value < 0 {
+				return nil, errors.New("ERR MAXLEN can't be negative")
+			}
+			maxLen = value
+		default:
+			return nil, ErrSyntax
+		}
+	}
 
-	values, err := listRange(key, start, end)
+	limit := count
+	if count < 0 {
+		// without COUNT only the first match matters
+		limit = 1
+	}
+	var positions []int64
+	err := view(c, func(txn *badger.Txn) error {
+		var err error
+		positions, err = listPositions(txn, key, args[2], rank, limit, maxLen)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return goresp.Marshal(values)
+	if count >= 0 {
+		reply := make([]interface{}, 0, len(positions))
+		for _, position := range positions {
+			reply = append(reply, position)
+		}
+		return reply, nil
+	}
+	if len(positions) == 0 {
+		return nil, nil
+	}
+	return positions[0], nil
+}
+
+func llen(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+	var value int64
+	err := view(c, func(txn *badger.Txn) error {
+		var err error
+		value, err = listLength(txn, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
 }
 
-func keys(args []interface{}) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("ERR Invalid argument")
+func lrange(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
+
+	startStr := string(args[2])
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
 	}
 
+	endStr := string(args[3])
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+
+	// the size of the reply is checked before any of it is sent, then the elements are
+	// streamed to the client while they are read, unless the command is run by EXEC
+	// whose replies are all sent once it is done, or the client has no connection to
+	// stream to
+	var values [][]byte
+	streamed := false
+	err = view(c, func(txn *badger.Txn) error {
+		metadata, ok, err := listGetMetadata(txn, key)
+		if err != nil || !ok {
+			return err
+		}
+		start, end := listRangePositions(int64(metadata.size), start, end)
+		if end < start {
+			return nil
+		}
+		if c.maxReplySize > 0 {
+			err = listCheckRangeSize(txn, key, metadata, start, end, c.maxReplySize)
+			if err != nil {
+				return err
+			}
+		}
+		if c.txn != nil || c.conn == nil {
+			values, err = listRange(txn, key, start, end)
+			return err
+		}
+		streamed = true
+		return c.streamArray(end-start+1, func(write func(element []byte) error) error {
+			return listWalkElements(txn, key, metadata, start, end, false, func(position int64, value []byte) (bool, error) {
+				return true, write(value)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if streamed {
+		return noReply, nil
+	}
+	return values, nil
+}
+
+func keys(c *client, args [][]byte) (interface{}, error) {
 	results := []interface{}{}
 	var keyCopy []byte
-	db.View(func(txn *badger.Txn) error {
+	view(c, func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -197,23 +673,142 @@ func keys(args []interface{}) ([]byte, error) {
 		return nil
 	})
 
-	resp, err := goresp.Marshal(results)
-	return resp, err
+	return results, nil
+}
+
+// object implements OBJECT ENCODING, the other subcommands report data the storage does
+// not keep
+func object(c *client, args [][]byte) (interface{}, error) {
+	if strings.ToUpper(string(args[1])) != "ENCODING" || len(args) != 3 {
+		return nil, fmt.Errorf("ERR Unknown subcommand or wrong number of arguments for '%s'", args[1])
+	}
+
+	var encoding interface{}
+	err := view(c, func(txn *badger.Txn) error {
+		value, err := stringGet(txn, args[2])
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			encoding = []byte(stringEncoding(value))
+			return nil
+		}
+		metadata, ok, err := listGetMetadata(txn, args[2])
+		if ok {
+			encoding = []byte(metadata.encoding())
+		}
+		return err
+	})
+	return encoding, err
+}
+
+// stringEncoding is the encoding redis would use for a string value
+func stringEncoding(value []byte) string {
+	if len(value) <= 20 {
+		_, err := strconv.ParseInt(string(value), 10, 64)
+		if err == nil {
+			return "int"
+		}
+	}
+	if len(value) <= 44 {
+		return "embstr"
+	}
+	return "raw"
+}
+
+// ping replies PONG, or the message it is given. RESP2 subscribers get it as a pub/sub
+// style array since their connection only carries messages.
+func ping(c *client, args [][]byte) (interface{}, error) {
+	if c.proto == 2 && c.isSubscribed() {
+		message := []byte{}
+		if len(args) > 1 {
+			message = args[1]
+		}
+		return []interface{}{[]byte("pong"), message}, nil
+	}
+	return "PONG", nil
 }
 
-func ping(args []interface{}) ([]byte, error) {
-	return goresp.Marshal("PONG")
+// quit replies OK and closes the connection once the reply is sent
+func quit(c *client, args [][]byte) (interface{}, error) {
+	c.close()
+	return "OK", nil
 }
 
-func command2(args []interface{}) ([]byte, error) {
+// hello switches the connection to the requested protocol version, it can also
+// authenticate and set the connection name in the same round trip
+func hello(c *client, args [][]byte) (interface{}, error) {
+	proto := c.proto
+	user := c.currentUser()
+	var name []byte
+	hasName := false
+	if len(args) > 1 {
+		version, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if version < 2 || version > 3 {
+			return nil, ErrUnsupportedProtocol
+		}
+		proto = int(version)
+
+		for i := 2; i < len(args); i++ {
+			remaining := len(args) - i - 1
+			option := strings.ToUpper(string(args[i]))
+			if option == "AUTH" && remaining >= 2 {
+				u, err := acl.authenticate(args[i+1], args[i+2])
+				if err != nil {
+					return nil, err
+				}
+				user = u
+				i += 2
+			} else if option == "SETNAME" && remaining >= 1 {
+				if !isValidClientName(args[i+1]) {
+					return nil, ErrInvalidClientName
+				}
+				name = args[i+1]
+				hasName = true
+				i++
+			} else {
+				return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+			}
+		}
+	}
+
+	if user == nil {
+		return nil, errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	c.setUser(user)
+	c.setProto(proto)
+	if hasName {
+		c.setName(string(name))
+	}
+
+	return respMap{
+		{"server", []byte("redis")},
+		{"version", []byte(serverVersion)},
+		{"proto", proto},
+		{"id", c.id},
+		{"mode", []byte("standalone")},
+		{"role", []byte("master")},
+		{"modules", []interface{}{}},
+	}, nil
+}
+
+func command2(c *client, args [][]byte) (interface{}, error) {
 	commands := []interface{}{}
 	for _, cmd := range commandMap {
-		commands = append(commands, cmd.Slice())
+		if c.proto >= 3 {
+			commands = append(commands, cmd.Map())
+		} else {
+			commands = append(commands, cmd.Slice())
+		}
 	}
-	return goresp.Marshal(commands)
+	return commands, nil
 }
 
-func seq(args []interface{}) ([]byte, error) {
+func seq(c *client, args [][]byte) (interface{}, error) {
 	result, err := db.GetSequence([]byte("_seq"), 1000)
 	defer result.Release()
 
@@ -222,86 +817,628 @@ func seq(args []interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	return goresp.Marshal(id)
+	return id, nil
 }
 
-func info(args []interface{}) ([]byte, error) {
-	serverInfo := fmt.Sprintf("# Server\r\n"+
-		"redis_version: 6.73\r\n"+
+// infoSections are the sections shown by INFO, in order
+var infoSections = []struct {
+	name    string
+	title   string
+	content func() string
+}{
+	{"server", "Server", serverInfo},
+	{"clients", "Clients", clientsInfo},
+	{"stats", "Stats", statsInfo},
+}
+
+func serverInfo() string {
+	return fmt.Sprintf("redis_version: "+serverVersion+"\r\n"+
 		"redis_git_sha1: 000000\r\n"+
 		"redis_git_dirty: 0\r\n"+
 		"redis_build_id: 1\r\n"+
 		"redis_mode: standalone\r\n"+
 		"os: %s\r\n"+
 		"arch_bits: 64\r\n", runtime.GOOS)
+}
 
-	return goresp.Marshal([]byte(serverInfo))
+func clientsInfo() string {
+	return fmt.Sprintf("connected_clients:%d\r\n"+
+		"blocked_clients:%d\r\n",
+		srv.clientCount(),
+		blocking.blockedCount(),
+	)
 }
 
-func handleConnection(conn net.Conn) {
+func statsInfo() string {
+	return fmt.Sprintf("txn_conflicts:%d\r\n"+
+		"txn_conflict_retries:%d\r\n"+
+		"txn_conflict_failures:%d\r\n",
+		atomic.LoadInt64(&conflictStats.conflicts),
+		atomic.LoadInt64(&conflictStats.retries),
+		atomic.LoadInt64(&conflictStats.failures),
+	)
+}
+
+// info shows every section, or only the requested one
+func info(c *client, args [][]byte) (interface{}, error) {
+	if len(args) > 2 {
+		return nil, ErrSyntax
+	}
+	section := "default"
+	if len(args) == 2 {
+		section = strings.ToLower(string(args[1]))
+	}
+
+	var text strings.Builder
+	for _, s := range infoSections {
+		if section != "default" && section != "all" && section != "everything" && section != s.name {
+			continue
+		}
+		if text.Len() > 0 {
+			text.WriteString("\r\n")
+		}
+		text.WriteString("# " + s.title + "\r\n")
+		text.WriteString(s.content())
+	}
+
+	return respVerbatim{"txt", []byte(text.String())}, nil
+}
+
+// shutdown stops the server. SAVE and NOSAVE are accepted for compatibility but make no
+// difference: writes are persisted as they are committed and closing the database
+// flushes the rest, there is no snapshot to skip.
+func shutdown(c *client, args [][]byte) (interface{}, error) {
+	if len(args) > 2 {
+		return nil, ErrSyntax
+	}
+	if len(args) == 2 {
+		switch strings.ToUpper(string(args[1])) {
+		case "SAVE", "NOSAVE":
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	logger.Info("User requested shutdown")
+	srv.requestShutdown()
+	// The connection is closed during the shutdown, there is no reply
+	return noReply, nil
+}
+
+// dispatch runs the command, or queues it when the client is in a MULTI block
+func dispatch(c *client, args [][]byte) (interface{}, error) {
+	cmd, err := lookupCommand(c, args)
+	if err != nil {
+		if c.multi != nil {
+			c.multi.failed = true
+		}
+		return nil, err
+	}
+
+	if c.multi != nil && cmd.hasFlag(CommandFlagNoMulti) {
+		c.multi.failed = true
+		return nil, ErrNotAllowedInMulti
+	}
+	if c.multi != nil && !unqueuedCommands[cmd.name] {
+		c.multi.commands = append(c.multi.commands, queuedCommand{cmd, args})
+		return "QUEUED", nil
+	}
+	return call(c, cmd, args)
+}
+
+// lookupCommand looks the command up in commandMap, checks its arity, whether the user
+// of the connection is allowed to run it and whether it can be sent in subscribed mode
+func lookupCommand(c *client, args [][]byte) (command, error) {
+	cmdName := strings.ToUpper(string(args[0]))
+	cmd, ok := commandMap[cmdName]
+	if !ok {
+		logger.Info("Received unknown command", zap.String("cmd", cmdName))
+		return cmd, fmt.Errorf("ERR unknown command `%s`", cmdName)
+	}
+	if !cmd.checkArity(len(args)) {
+		return cmd, fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.name)
+	}
+	err := acl.checkPermission(c.currentUser(), cmd, args)
+	if err != nil {
+		return cmd, err
+	}
+	if c.proto == 2 && c.isSubscribed() && !subscribedModeCommands[cmd.name] {
+		return cmd, fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", cmd.name)
+	}
+	return cmd, nil
+}
+
+// call runs the handler of the command. Once the write is committed its keys are
+// touched, which fails the transactions watching the ones it changed, and the clients
+// blocked on them are woken up. In EXEC both wait for the commit of the transaction.
+func call(c *client, cmd command, args [][]byte) (interface{}, error) {
+	if !cmd.hasFlag(CommandFlagWrite) {
+		return cmd.handler(c, args)
+	}
+
+	keys := cmd.keyArgs(args)
+	reply, err := cmd.handler(c, args)
+	if err == nil && c.txn != nil {
+		c.writtenKeys = append(c.writtenKeys, keys...)
+	} else if err == nil {
+		watches.touch(keys)
+		blocking.signal(keys)
+	}
+	return reply, err
+}
+
+// safeDispatch runs the command and turns a panic in its handler into an error reply,
+// the connection stays open for the next commands
+func safeDispatch(c *client, args [][]byte) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Command handler panicked",
+				zap.String("cmd", string(args[0])),
+				zap.String("addr", c.addr()),
+				zap.Any("panic", r),
+				zap.Stack("stack"),
+			)
+			result, err = nil, ErrInternal
+		}
+	}()
+
+	return dispatch(c, args)
+}
+
+func handleConnection(c *client) {
+	defer c.conn.Close()
+	defer watches.unwatch(c)
+	defer c.stopPushing()
+	defer pubsub.unsubscribeAll(c)
 	for {
-		raw, err := goresp.Unmarshal(conn)
-		if err == io.EOF {
+		args, err := c.reader.ReadCommand()
+		if err == io.EOF || c.isClosing() {
 			// connection closed
 			break
 		}
+		if perr, ok := err.(protocolError); ok {
+			c.replyProtocolError(perr)
+			break
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			logger.Debug("Closing idle client", zap.String("addr", c.addr()))
+			break
+		}
 		if err != nil {
-			fmt.Printf("ERR: %s\n", err.Error())
+			logger.Debug("Cannot read from connection", zap.Error(err))
 			break
 		}
-		cmd := raw.([]interface{})
-		if len(cmd) == 0 {
+		if len(args) == 0 {
+			// blank line or empty array, nothing to do
+			continue
+		}
+
+		if !c.beginCommand(strings.ToLower(string(args[0]))) {
 			break
 		}
-		cmdName := strings.ToUpper(string(cmd[0].([]byte)))
-		if handler, ok := commandMap[cmdName]; ok {
-			result, err := handler.handler(cmd)
-			if err != nil {
-				result, _ = goresp.Marshal(err.Error())
+		result, err := safeDispatch(c, args)
+		if err != nil {
+			result = err
+		}
+		err = c.writeReply(result)
+		if err == nil {
+			err = c.flushReplies()
+		}
+		if err != nil {
+			logger.Debug("Cannot write to connection", zap.Error(err))
+			c.endCommand()
+			break
+		}
+		if !c.endCommand() {
+			// the replies are held back while pipelined commands are waiting, they
+			// are not run but the replies of the ones which were must be sent
+			c.flush()
+			break
+		}
+	}
+}
+
+// server keeps track of the listeners and the connected clients so they can be
+// stopped gracefully
+type server struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	clients   map[*client]struct{}
+	closing   bool
+
+	// maxClients is how many clients can be connected at once, 0 for no limit
+	maxClients int
+	// idleTimeout closes clients which sent nothing for that long, 0 disables it
+	idleTimeout time.Duration
+	// keepAlive is the TCP keepalive period of new connections, 0 disables keepalives
+	keepAlive time.Duration
+	// pubsubOutputLimit applies to the messages waiting to be sent to subscribers
+	pubsubOutputLimit OutputBufferLimit
+	// maxReplySize bounds the size of LRANGE replies, 0 disables it
+	maxReplySize int64
+
+	acceptors sync.WaitGroup
+	handlers  sync.WaitGroup
+
+	// shutdownRequests receives a request from the SHUTDOWN command
+	shutdownRequests chan struct{}
+}
+
+func newServer() *server {
+	return &server{
+		clients:          map[*client]struct{}{},
+		shutdownRequests: make(chan struct{}, 1),
+	}
+}
+
+var srv = newServer()
+
+// listen starts accepting connections on address, they are served over TLS when
+// tlsConfig is not nil
+func (s *server) listen(network, address string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		listener = keepAliveListener{tcpListener, s.keepAlive}
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return s.serve(listener)
+}
+
+// keepAliveListener sets the keepalive period of accepted connections, it wraps the
+// TCP listener so it also applies to TLS connections
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.period > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(l.period)
+	} else {
+		conn.SetKeepAlive(false)
+	}
+	return conn, nil
+}
+
+// listenUnix starts accepting connections on a unix socket, a stale socket left by a
+// previous run is removed first. The socket file is removed when the server shuts down.
+func (s *server) listenUnix(path string, perm os.FileMode) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if perm != 0 {
+		err = os.Chmod(path, perm)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	return s.serve(listener)
+}
+
+// serve accepts connections from listener until the server shuts down
+func (s *server) serve(listener net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		listener.Close()
+		return ErrShuttingDown
+	}
+	s.listeners = append(s.listeners, listener)
+	s.acceptors.Add(1)
+	go s.acceptConnections(listener)
+	return nil
+}
+
+func (s *server) acceptConnections(listener net.Listener) {
+	defer s.acceptors.Done()
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return
 			}
-			_, err = conn.Write(result)
-			if err != nil {
-				logger.Error("Cannot write to connection", zap.Error(err))
+			// Running out of file descriptors is the usual cause, retrying right away
+			// would only spin
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > time.Second {
+				backoff = time.Second
 			}
+			logger.Error("Cannot accept connection", zap.Error(err), zap.Duration("retry-in", backoff))
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
 
-		} else {
-			logger.Info("Received unknown command", zap.String("cmd", cmdName))
-			result, _ := goresp.Marshal(fmt.Errorf("ERR unknown command `%s`", cmdName))
-			conn.Write(result)
+		c := newClient(conn)
+		c.idleTimeout = s.idleTimeout
+		c.outputLimit = s.pubsubOutputLimit
+		c.maxReplySize = s.maxReplySize
+		err = s.addClient(c)
+		if err == ErrMaxClients {
+			logger.Warn("Rejecting client, max number of clients reached", zap.String("addr", c.addr()), zap.Int("maxclients", s.maxClients))
+			go rejectClient(conn, err)
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			continue
 		}
+		go func() {
+			defer s.removeClient(c)
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				err := tlsHandshake(tlsConn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+			}
+			handleConnection(c)
+		}()
 	}
 }
 
-var db *badger.DB
-var logger *zap.Logger
+// addClient registers a new client, it fails when the server is shutting down or when
+// too many clients are connected
+func (s *server) addClient(c *client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return ErrShuttingDown
+	}
+	if s.maxClients > 0 && len(s.clients) >= s.maxClients {
+		return ErrMaxClients
+	}
+	s.clients[c] = struct{}{}
+	s.handlers.Add(1)
+	return nil
+}
 
-func init() {
-	logger, _ = zap.NewDevelopment()
-	defer logger.Sync()
-	var err error
-	db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true))
-	if err != nil {
-		logger.Panic(err.Error())
+// rejectClient tells a client it cannot be served before closing its connection, the
+// reply is sent from its own goroutine so a slow client does not block the accept loop
+func rejectClient(conn net.Conn, err error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	reply, _ := appendReply(nil, err, 2)
+	conn.Write(reply)
+}
+
+func (s *server) removeClient(c *client) {
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+func (s *server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+func (s *server) requestShutdown() {
+	select {
+	case s.shutdownRequests <- struct{}{}:
+	default:
+		// a shutdown is already pending
+	}
+}
+
+// clientList returns the connected clients sorted by id
+func (s *server) clientList() []*client {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+func (s *server) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// closeClients closes the clients for which match returns true, it returns how many
+// were closed
+func (s *server) closeClients(match func(c *client) bool) int {
+	s.mu.Lock()
+	matching := []*client{}
+	for c := range s.clients {
+		if match(c) {
+			matching = append(matching, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range matching {
+		c.close()
+	}
+	return len(matching)
+}
+
+// Shutdown stops accepting connections, lets the running commands finish and closes
+// every client. Clients that are still busy after timeout are disconnected.
+func (s *server) Shutdown(timeout time.Duration) {
+	s.mu.Lock()
+	s.closing = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	s.acceptors.Wait()
+	for _, c := range clients {
+		c.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	logger.Warn("Clients did not finish in time, disconnecting them")
+	for _, c := range clients {
+		c.conn.Close()
 	}
+	<-done
+}
+
+var db *badger.DB
+var logger = zap.NewNop()
 
+func init() {
 	cmd := commandMap["COMMAND"]
 	cmd.handler = command2
 	commandMap["COMMAND"] = cmd
 }
 
 func main() {
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FATAL CONFIG ERROR: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	logger, err = cfg.Logger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot create logger: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
 	logger.Info("Artimis Server v0.1")
-	listener, err := net.Listen("tcp", "0.0.0.0:6379")
+
+	cfg.Storage.Logger = logger
+	db, err = openStorage(cfg.Storage)
+	if err != nil {
+		logger.Fatal("Cannot open database", zap.Error(err))
+	}
+	if cfg.Storage.InMemory {
+		logger.Info("Running with in-memory storage")
+	} else {
+		logger.Info("Opened database", zap.String("dir", cfg.Storage.Dir), zap.Bool("sync-writes", cfg.Storage.SyncWrites))
+	}
+	migrated, err := migrateStorage(db)
 	if err != nil {
-		panic(err)
+		logger.Fatal("Cannot migrate database", zap.Error(err))
+	}
+	if migrated > 0 {
+		logger.Info("Migrated lists to the current storage layout", zap.Int("lists", migrated))
 	}
 
-	logger.Info("Listening on 0.0.0.0:6379")
-	for {
-		conn, err := listener.Accept()
+	srv.maxClients = cfg.MaxClients
+	srv.idleTimeout = time.Duration(cfg.Timeout) * time.Second
+	srv.keepAlive = time.Duration(cfg.TCPKeepAlive) * time.Second
+	srv.pubsubOutputLimit = cfg.PubSubOutputLimit
+	srv.maxReplySize = cfg.MaxReplySize
+	setKeyspaceEvents(cfg.NotifyKeyspaceEvents)
+	setListEncoding(cfg.ListEncoding, cfg.ListChunkSize)
+	if cfg.ListEncoding == listEncodingQuicklist {
+		logger.Info("Creating lists with the quicklist encoding", zap.Int64("list-chunk-size", cfg.ListChunkSize))
+	}
+	if cfg.NotifyKeyspaceEvents != 0 {
+		logger.Info("Publishing keyspace events", zap.String("notify-keyspace-events", formatNotifyFlags(cfg.NotifyKeyspaceEvents)))
+	}
+
+	if cfg.ACLFile != "" {
+		acl.file = cfg.ACLFile
+		_, err = acl.load()
+		if err != nil {
+			logger.Fatal("Cannot load the ACL file", zap.Error(err))
+		}
+		logger.Info("Loaded users", zap.String("aclfile", cfg.ACLFile), zap.Strings("users", acl.usernames()))
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSPort != 0 {
+		tlsConfig, err = cfg.TLS.serverConfig()
+		if err != nil {
+			logger.Fatal("Cannot configure TLS", zap.Error(err))
+		}
+	}
+	for _, address := range cfg.Bind {
+		if cfg.Port != 0 {
+			tcpAddress := net.JoinHostPort(address, strconv.Itoa(cfg.Port))
+			err = srv.listen("tcp", tcpAddress, nil)
+			if err != nil {
+				logger.Fatal("Cannot listen", zap.String("address", tcpAddress), zap.Error(err))
+			}
+			logger.Info("Listening", zap.String("address", tcpAddress))
+		}
+		if cfg.TLSPort != 0 {
+			tlsAddress := net.JoinHostPort(address, strconv.Itoa(cfg.TLSPort))
+			err = srv.listen("tcp", tlsAddress, tlsConfig)
+			if err != nil {
+				logger.Fatal("Cannot listen", zap.String("address", tlsAddress), zap.Error(err))
+			}
+			logger.Info("Listening for TLS connections", zap.String("address", tlsAddress), zap.String("tls-auth-clients", cfg.TLS.AuthClients))
+		}
+	}
+
+	if cfg.UnixSocket != "" {
+		err = srv.listenUnix(cfg.UnixSocket, cfg.UnixSocketPerm)
 		if err != nil {
-			fmt.Println(err)
+			logger.Fatal("Cannot listen", zap.String("unixsocket", cfg.UnixSocket), zap.Error(err))
 		}
-		go handleConnection(conn)
+		logger.Info("Listening", zap.String("unixsocket", cfg.UnixSocket), zap.Stringer("unixsocketperm", cfg.UnixSocketPerm))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logger.Info("Received signal, shutting down", zap.Stringer("signal", sig))
+	case <-srv.shutdownRequests:
+	}
+
+	srv.Shutdown(time.Duration(cfg.ShutdownTimeout) * time.Second)
+	// closing the database syncs it to disk
+	err = db.Close()
+	if err != nil {
+		logger.Error("Cannot close database", zap.Error(err))
 	}
+	logger.Info("Atossa is now ready to exit, bye bye...")
 }
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves connections with handleConnection on a random local port
+func startTestServer(tb testing.TB) (string, func()) {
+	return startTestServerWith(tb, newClient)
+}
+
+// startTestServerWith is startTestServer creating the clients with newTestClient
+func startTestServerWith(tb testing.TB, newTestClient func(conn net.Conn) *client) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(newTestClient(conn))
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// readReplies reads count single line replies like +OK or :1
+func readReplies(reader *bufio.Reader, count int) error {
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if line[0] == '-' {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atossa-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "atossa.sock")
+
+	// A socket left behind by a server which did not exit cleanly is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := newServer()
+	err = s.listenUnix(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("Expected permissions=%v\nActual permissions=%v", os.FileMode(0700), info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("PING\r\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || reply != "+PONG\r\n" {
+		t.Fatalf("Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+	}
+
+	s.Shutdown(time.Second)
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed on shutdown, Actual err=%v", err)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	s := newServer()
+	s.maxClients = 1
+	defer s.Shutdown(time.Second)
+	err := s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	first.Write([]byte("PING\r\n"))
+	reader := bufio.NewReader(first)
+	reply, err := reader.ReadString('\n')
+	if err != nil || reply != "+PONG\r\n" {
+		t.Fatalf("First client: Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err = bufio.NewReader(second).ReadString('\n')
+	if err != nil || reply != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("Second client: Expected reply=%q, Actual reply=%q, err=%v", "-ERR max number of clients reached\r\n", reply, err)
+	}
+
+	// the first client is still served
+	first.Write([]byte("PING\r\n"))
+	reply, err = reader.ReadString('\n')
+	if err != nil || reply != "+PONG\r\n" {
+		t.Fatalf("First client: Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := newServer()
+	s.idleTimeout = 100 * time.Millisecond
+	defer s.Shutdown(time.Second)
+	err := s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("PING\r\n"))
+		reply, err := reader.ReadString('\n')
+		if err != nil || reply != "+PONG\r\n" {
+			t.Fatalf("Active client: Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+		}
+	}
+
+	started := time.Now()
+	_, err = reader.ReadString('\n')
+	if err != io.EOF || time.Since(started) > 2*time.Second {
+		t.Fatalf("Idle client: Expected to be disconnected, Actual err=%v after %v", err, time.Since(started))
+	}
+}
+
+func TestStreamedRange(t *testing.T) {
+	err := db.DropAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer()
+	s.maxReplySize = 40
+	defer s.Shutdown(time.Second)
+	err = s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, reader := dialTestClient(t, s.listeners[0].Addr().String())
+	defer conn.Close()
+
+	testCases := []struct {
+		title   string
+		command string
+		reply   string
+	}{
+		{"setup", "RPUSH key a b c d e", ":5\r\n"},
+		{"whole list", "LRANGE key 0 -1", "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{"negative offsets", "LRANGE key -2 10", "*2\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{"empty range", "LRANGE key 3 1", "*0\r\n"},
+		{"missing key", "LRANGE missing 0 -1", "*0\r\n"},
+		{"in a transaction", "MULTI\r\nLRANGE key 0 1\r\nEXEC", "+OK\r\n+QUEUED\r\n*1\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"over max-reply-size", "RPUSH key fghijklm\r\nLRANGE key 0 -1", ":6\r\n-ERR reply is larger than max-reply-size\r\n"},
+		{"under max-reply-size", "LRANGE key -1 -1", "*1\r\n$8\r\nfghijklm\r\n"},
+		{"over max-reply-size in a transaction", "MULTI\r\nLRANGE key 0 -1\r\nEXEC", "+OK\r\n+QUEUED\r\n*1\r\n-ERR reply is larger than max-reply-size\r\n"},
+		{"empty elements count", "RPUSH empty \"\" \"\" \"\" \"\" \"\" \"\" \"\"\r\nLRANGE empty 0 -1", ":7\r\n-ERR reply is larger than max-reply-size\r\n"},
+		{"empty elements under max-reply-size", "LRANGE empty 0 1", "*2\r\n$0\r\n\r\n$0\r\n\r\n"},
+	}
+	for _, testCase := range testCases {
+		conn.Write([]byte(testCase.command + "\r\n"))
+		expectReply(t, testCase.title, reader, testCase.reply)
+	}
+
+	// large replies are sent in several batches, one over max-reply-size is refused before
+	// any of it is sent
+	large := newServer()
+	large.maxReplySize = 100 * 1024
+	defer large.Shutdown(time.Second)
+	err = large.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, reader = dialTestClient(t, large.listeners[0].Addr().String())
+	defer conn.Close()
+	element := strings.Repeat("x", 100)
+	push := "RPUSH big" + strings.Repeat(" "+element, 100) + "\r\n"
+	for i := 0; i < 20; i++ {
+		conn.Write([]byte(push))
+		expectReply(t, "push", reader, ":"+strconv.Itoa((i+1)*100)+"\r\n")
+	}
+	conn.Write([]byte("LRANGE big 0 899\r\n"))
+	expectReply(t, "several batches", reader, "*900\r\n"+strings.Repeat("$100\r\n"+element+"\r\n", 900))
+	conn.Write([]byte("LRANGE big 0 -1\r\nPING\r\n"))
+	expectReply(t, "over max-reply-size after the first batch", reader, "-ERR reply is larger than max-reply-size\r\n+PONG\r\n")
+}
+
+// addTestCommand registers a command until the returned function is called. It is
+// flagged no_auth as the users were given their commands before it existed.
+func addTestCommand(name string, handler commandHandler) func() {
+	commandMap[strings.ToUpper(name)] = command{
+		name:    name,
+		arity:   -1,
+		flags:   []CommandFlag{CommandFlagReadonly, CommandFlagNoAuth},
+		handler: handler,
+	}
+	return func() { delete(commandMap, strings.ToUpper(name)) }
+}
+
+func TestHello(t *testing.T) {
+	testCases := []struct {
+		title string
+		args  string
+		proto int
+		reply string
+	}{
+		{"current protocol", "HELLO", 2, "*14\r\n+server\r\n$5\r\nredis\r\n+version\r\n$4\r\n6.73\r\n+proto\r\n:2\r\n"},
+		{"RESP3", "HELLO 3", 3, "%7\r\n+server\r\n$5\r\nredis\r\n+version\r\n$4\r\n6.73\r\n+proto\r\n:3\r\n"},
+		{"back to RESP2", "HELLO 2", 2, "*14\r\n+server\r\n$5\r\nredis\r\n+version\r\n$4\r\n6.73\r\n+proto\r\n:2\r\n"},
+		{"unsupported version", "HELLO 4", 2, "-NOPROTO unsupported protocol version\r\n"},
+		{"not a version", "HELLO three", 2, "-ERR Protocol version is not an integer or out of range\r\n"},
+		{"unknown option", "HELLO 3 FOO", 2, "-ERR Syntax error in HELLO option 'FOO'\r\n"},
+	}
+
+	c := newClient(nil)
+	for _, testCase := range testCases {
+		args, err := splitArgs([]byte(testCase.args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := dispatch(c, args)
+		if err != nil {
+			result = err
+		}
+		reply, err := appendReply(nil, result, c.proto)
+		if err != nil || !strings.HasPrefix(string(reply), testCase.reply) || c.proto != testCase.proto {
+			t.Fatalf("Case \"%s\":\n Expected proto=%d, reply=%q...\n Actual proto=%d, reply=%q, err=%v", testCase.title, testCase.proto, testCase.reply, c.proto, reply, err)
+		}
+	}
+}
+
+func TestQuit(t *testing.T) {
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	testCases := []struct {
+		title string
+		input string
+		reply string
+	}{
+		{"quit", "QUIT\r\n", "+OK\r\n"},
+		{"pipelined commands are not run", "QUIT\r\nPING\r\n", "+OK\r\n"},
+		{"in a transaction", "MULTI\r\nQUIT\r\n", "+OK\r\n+OK\r\n"},
+		{"subscribed", "SUBSCRIBE ch\r\nQUIT\r\n", "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n+OK\r\n"},
+	}
+	for _, testCase := range testCases {
+		conn, reader := dialTestClient(t, addr)
+		conn.Write([]byte(testCase.input))
+		expectReply(t, testCase.title, reader, testCase.reply)
+		_, err := reader.ReadByte()
+		if err == nil {
+			t.Fatalf("Case \"%s\":\n Expected the connection to be closed", testCase.title)
+		}
+		conn.Close()
+	}
+}
+
+func TestShutdownCommand(t *testing.T) {
+	testCases := []struct {
+		title     string
+		args      [][]byte
+		reply     interface{}
+		err       error
+		requested bool
+	}{
+		{"default", [][]byte{[]byte("SHUTDOWN")}, noReply, nil, true},
+		{"save", [][]byte{[]byte("SHUTDOWN"), []byte("save")}, noReply, nil, true},
+		{"nosave", [][]byte{[]byte("SHUTDOWN"), []byte("NOSAVE")}, noReply, nil, true},
+		{"unknown option", [][]byte{[]byte("SHUTDOWN"), []byte("NOW")}, nil, ErrSyntax, false},
+	}
+
+	for _, testCase := range testCases {
+		reply, err := dispatch(newClient(nil), testCase.args)
+		requested := false
+		select {
+		case <-srv.shutdownRequests:
+			requested = true
+		default:
+		}
+		if reply != testCase.reply || err != testCase.err || requested != testCase.requested {
+			t.Fatalf("Case \"%s\":\n Expected reply=%v, err=%v, requested=%v\n Actual reply=%v, err=%v, requested=%v", testCase.title, testCase.reply, testCase.err, testCase.requested, reply, err, requested)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer addTestCommand("slow", func(c *client, args [][]byte) (interface{}, error) {
+		close(started)
+		<-release
+		return "OK", nil
+	})()
+
+	s := newServer()
+	err := s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listeners[0].Addr().String()
+	conn, reader := dialTestClient(t, addr)
+	defer conn.Close()
+	conn.Write([]byte("SLOW\r\n"))
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown(5 * time.Second)
+		close(done)
+	}()
+	for !s.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the listeners are closed along with setting closing
+	refused, err := net.Dial("tcp", addr)
+	if err == nil {
+		refused.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = refused.Read(make([]byte, 1))
+		refused.Close()
+	}
+	if err == nil {
+		t.Fatalf("Expected new connections to be refused during shutdown")
+	}
+	select {
+	case <-done:
+		t.Fatalf("Expected shutdown to wait for the running command")
+	default:
+	}
+
+	close(release)
+	expectReply(t, "running command", reader, "+OK\r\n")
+	_, err = reader.ReadByte()
+	if err != io.EOF {
+		t.Fatalf("Expected the client to be disconnected after its command, Actual err=%v", err)
+	}
+	<-done
+}
+
+func TestConnectionErrors(t *testing.T) {
+	defer addTestCommand("panic", func(c *client, args [][]byte) (interface{}, error) {
+		panic("handler failure")
+	})()
+	addr, stop := startTestServer(t)
+	defer stop()
+
+	testCases := []struct {
+		title        string
+		input        string
+		reply        string
+		disconnected bool
+	}{
+		{"handler panic", "PANIC\r\n", "-ERR internal error\r\n", false},
+		{"malformed frame", "*1\r\n:1\r\n", "-ERR Protocol error: expected '$', got ':'\r\n", true},
+		{"invalid bulk length", "*1\r\n$-1\r\n", "-ERR Protocol error: invalid bulk length\r\n", true},
+		{"command name with line breaks", "*1\r\n$8\r\nFOO\r\n+OK\r\n", "-ERR unknown command `FOO  +OK`\r\n", false},
+		{"subcommand with line breaks", "*2\r\n$6\r\nCLIENT\r\n$6\r\nx\r\n+OK\r\n", "-ERR Unknown subcommand or wrong number of arguments for 'x  +OK'\r\n", false},
+	}
+	for _, testCase := range testCases {
+		conn, reader := dialTestClient(t, addr)
+		conn.Write([]byte(testCase.input))
+		expectReply(t, testCase.title, reader, testCase.reply)
+
+		// a connection which is still open answers the next command
+		conn.Write([]byte("PING\r\n"))
+		reply, err := reader.ReadString('\n')
+		disconnected := err != nil
+		if disconnected != testCase.disconnected || (!disconnected && reply != "+PONG\r\n") {
+			t.Fatalf("Case \"%s\":\n Expected disconnected=%v\n Actual disconnected=%v, reply=%q, err=%v", testCase.title, testCase.disconnected, disconnected, reply, err)
+		}
+		conn.Close()
+	}
+}
+
+// unbufferedClient sends each reply as soon as it is written, the way connections were
+// served before replies were buffered until the pipelined commands are executed
+func unbufferedClient(conn net.Conn) *client {
+	c := newClient(conn)
+	// replies larger than the buffer are written straight to the connection
+	c.writer = bufio.NewWriterSize(conn, 1)
+	return c
+}
+
+// benchmarkPipeline measures command sent in batches of pipeline commands, both with
+// buffered replies and with a write per reply as a baseline
+func benchmarkPipeline(b *testing.B, command []byte, pipeline int) {
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkPipelineWith(b, newClient, command, pipeline)
+	})
+	b.Run("unbuffered", func(b *testing.B) {
+		benchmarkPipelineWith(b, unbufferedClient, command, pipeline)
+	})
+}
+
+func benchmarkPipelineWith(b *testing.B, newTestClient func(conn net.Conn) *client, command []byte, pipeline int) {
+	addr, stop := startTestServerWith(b, newTestClient)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	batch := bytes.Repeat(command, pipeline)
+
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += pipeline {
+		count := pipeline
+		if b.N-sent < count {
+			count = b.N - sent
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(batch[:count*len(command)])
+			errs <- err
+		}()
+		err = readReplies(reader, count)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = <-errs
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchmarkPING = []byte("*1\r\n$4\r\nPING\r\n")
+
+func benchmarkRPUSH(key string) []byte {
+	return []byte("*3\r\n$5\r\nRPUSH\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n$5\r\nvalue\r\n")
+}
+
+func BenchmarkPING(b *testing.B) {
+	benchmarkPipeline(b, benchmarkPING, 1)
+}
+
+func BenchmarkPipelinedPING(b *testing.B) {
+	benchmarkPipeline(b, benchmarkPING, 10000)
+}
+
+func BenchmarkRPUSH(b *testing.B) {
+	benchmarkPipeline(b, benchmarkRPUSH("bench-rpush"), 1)
+}
+
+func BenchmarkPipelinedRPUSH(b *testing.B) {
+	benchmarkPipeline(b, benchmarkRPUSH("bench-pipelined-rpush"), 10000)
+}
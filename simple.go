@@ -1,57 +1,70 @@
 package main
 
 import (
-	"errors"
-	"github.com/0xc0d3d00d/goresp"
 	badger "github.com/dgraph-io/badger/v2"
 )
 
-func set(args []interface{}) ([]byte, error) {
+func stringSet(txn *badger.Txn, key, value []byte) error {
+	return txn.Set(key, value)
+}
+
+// stringGet returns the value of key, or nil if it does not exist
+func stringGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	err = item.Value(func(val []byte) error {
+		// an empty string is not nil, it is not the same as a missing key
+		value = append([]byte{}, val...)
+		return nil
+	})
+	return value, err
+}
+
+func set(c *client, args [][]byte) (interface{}, error) {
 	if len(args) != 3 {
-		return nil, errors.New("ERR invalid arguments")
+		// EX, PX, NX, XX and KEEPTTL are not supported yet
+		return nil, ErrSyntax
 	}
 
-	key := args[1].([]byte)
-	value := args[2].([]byte)
+	key := args[1]
+	value := args[2]
 
-	err := db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, value)
+	err := update(c, func(txn *badger.Txn) error {
+		return stringSet(txn, key, value)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return goresp.Marshal("OK")
+	notifyKeyspaceEvent(c, notifyString, "set", key)
+	return "OK", nil
 }
 
-func get(args []interface{}) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("ERR invalid arguments")
-	}
-
-	key := args[1].([]byte)
+func get(c *client, args [][]byte) (interface{}, error) {
+	key := args[1]
 
 	var value []byte
-	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
-		}
-
-		err = item.Value(func(val []byte) error {
-			value = append([]byte{}, val...)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-		return nil
+	err := view(c, func(txn *badger.Txn) error {
+		var err error
+		value, err = stringGet(txn, key)
+		return err
 	})
 
 	if err != nil {
 		return nil, err
 	}
+	if value == nil {
+		notifyKeyspaceEvent(c, notifyKeyMiss, "keymiss", key)
+		return nil, nil
+	}
 
-	return goresp.Marshal(value)
+	return value, nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+	"go.uber.org/zap"
+	"os"
+)
+
+var ErrNoDataDir = errors.New("Data directory is not set")
+
+// StorageOptions describes how the badger store backing the server is opened,
+// zero values leave the badger defaults untouched
+type StorageOptions struct {
+	// Dir is the directory holding the keys and the value log, it is created if it does not exist
+	Dir string
+	// InMemory keeps everything in memory, nothing is written to Dir and all data is lost on exit
+	InMemory bool
+	// SyncWrites makes every write wait for the value log to be synced to disk
+	SyncWrites bool
+
+	MemTableSize     int64
+	NumMemtables     int
+	ValueThreshold   int64
+	ValueLogFileSize int64
+	BlockCacheSize   int64
+	IndexCacheSize   int64
+	NumCompactors    int
+	// Compression is one of none, snappy or zstd
+	Compression string
+
+	// Logger receives badger's own log messages, badger logs to stderr when it is nil
+	Logger *zap.Logger
+}
+
+func (opts StorageOptions) badgerOptions() badger.Options {
+	badgerOpts := badger.DefaultOptions(opts.Dir)
+	if opts.InMemory {
+		badgerOpts = badger.DefaultOptions("").WithInMemory(true)
+	}
+
+	badgerOpts = badgerOpts.WithSyncWrites(opts.SyncWrites)
+	if opts.MemTableSize > 0 {
+		badgerOpts = badgerOpts.WithMaxTableSize(opts.MemTableSize)
+	}
+	if opts.NumMemtables > 0 {
+		badgerOpts = badgerOpts.WithNumMemtables(opts.NumMemtables)
+	}
+	if opts.ValueThreshold > 0 {
+		badgerOpts = badgerOpts.WithValueThreshold(int(opts.ValueThreshold))
+	}
+	if opts.ValueLogFileSize > 0 {
+		badgerOpts = badgerOpts.WithValueLogFileSize(opts.ValueLogFileSize)
+	}
+	if opts.BlockCacheSize > 0 {
+		badgerOpts = badgerOpts.WithBlockCacheSize(opts.BlockCacheSize)
+	}
+	if opts.IndexCacheSize > 0 {
+		badgerOpts = badgerOpts.WithIndexCacheSize(opts.IndexCacheSize)
+	}
+	if opts.NumCompactors > 0 {
+		badgerOpts = badgerOpts.WithNumCompactors(opts.NumCompactors)
+	}
+	switch opts.Compression {
+	case "none":
+		badgerOpts = badgerOpts.WithCompression(options.None)
+	case "snappy":
+		badgerOpts = badgerOpts.WithCompression(options.Snappy)
+	case "zstd":
+		badgerOpts = badgerOpts.WithCompression(options.ZSTD)
+	}
+	if opts.Logger != nil {
+		badgerOpts = badgerOpts.WithLogger(badgerLogger{opts.Logger.Named("badger").Sugar()})
+	}
+
+	return badgerOpts
+}
+
+func openStorage(opts StorageOptions) (*badger.DB, error) {
+	if !opts.InMemory {
+		if opts.Dir == "" {
+			return nil, ErrNoDataDir
+		}
+		err := os.MkdirAll(opts.Dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return badger.Open(opts.badgerOptions())
+}
+
+// badgerLogger adapts zap to the badger.Logger interface
+type badgerLogger struct {
+	*zap.SugaredLogger
+}
+
+// Infof is demoted to debug, badger reports every compaction and flush at info level
+func (l badgerLogger) Infof(format string, args ...interface{}) {
+	l.Debugf(format, args...)
+}
+
+func (l badgerLogger) Warningf(format string, args ...interface{}) {
+	l.Warnf(format, args...)
+}
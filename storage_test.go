@@ -0,0 +1,87 @@
+package main
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	db, err = openStorage(StorageOptions{InMemory: true})
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	db.Close()
+	os.Exit(code)
+}
+
+func TestStorageReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atossa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inMemoryDB := db
+	defer func() { db = inMemoryDB }()
+
+	opts := StorageOptions{Dir: dir, SyncWrites: true}
+	db, err = openStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listValues := [][]byte{
+		[]byte{'f', 'o', 'o'},
+		[]byte{'b', 'a', 'r'},
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		_, err := listPush(txn, []byte{'l', 'i', 's', 't'}, listValues, DirectionRight)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = set(newClient(nil), [][]byte{[]byte("SET"), []byte{'s', 't', 'r'}, []byte{'v', 'a', 'l'}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var actualValues [][]byte
+	err = db.View(func(txn *badger.Txn) error {
+		actualValues, err = listRange(txn, []byte{'l', 'i', 's', 't'}, 0, -1)
+		return err
+	})
+	if err != nil || !reflect.DeepEqual(actualValues, listValues) {
+		t.Fatalf("Expected list=%v, Actual list=%v, err=%v", listValues, actualValues, err)
+	}
+
+	expectedReply := []byte{'v', 'a', 'l'}
+	actualReply, err := get(newClient(nil), [][]byte{[]byte("GET"), []byte{'s', 't', 'r'}})
+	if err != nil || !reflect.DeepEqual(actualReply, expectedReply) {
+		t.Fatalf("Expected reply=%q, Actual reply=%q, err=%v", expectedReply, actualReply, err)
+	}
+}
+
+func TestStorageWithoutDir(t *testing.T) {
+	_, err := openStorage(StorageOptions{})
+	if err != ErrNoDataDir {
+		t.Fatalf("Expected err=%v, Actual err=%v", ErrNoDataDir, err)
+	}
+}
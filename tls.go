@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client can take to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+var ErrNoTLSCertificate = errors.New("tls-cert-file and tls-key-file must be set to use TLS")
+
+// TLSOptions describes the TLS listener
+type TLSOptions struct {
+	CertFile   string
+	KeyFile    string
+	CACertFile string
+	// AuthClients is yes to require a client certificate signed by the CA, optional to
+	// only verify one when the client sends it and no to never ask for one
+	AuthClients string
+}
+
+func (opts TLSOptions) serverConfig() (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, ErrNoTLSCertificate
+	}
+	certificate, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch opts.AuthClients {
+	case "no":
+		config.ClientAuth = tls.NoClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if config.ClientAuth != tls.NoClientCert {
+		if opts.CACertFile == "" {
+			return nil, errors.New("tls-ca-cert-file must be set to authenticate clients")
+		}
+		pem, err := ioutil.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.CACertFile)
+		}
+	}
+
+	return config, nil
+}
+
+// tlsHandshake completes the handshake before the first command is read, so slow or
+// failed handshakes are bounded and logged
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		logger.Info("TLS handshake failed",
+			zap.String("addr", conn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA when
+// parent is nil
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (tc *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atossa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "Atossa Test CA", nil)
+	serverCert := newTestCertificate(t, "atossa", ca)
+	clientCert := newTestCertificate(t, "client", ca)
+	otherCA := newTestCertificate(t, "Other CA", nil)
+	untrustedCert := newTestCertificate(t, "untrusted", otherCA)
+
+	files := map[string][]byte{
+		"ca.crt":     ca.certPEM,
+		"server.crt": serverCert.certPEM,
+		"server.key": serverCert.keyPEM,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	testCases := []struct {
+		title        string
+		authClients  string
+		certificates []tls.Certificate
+		ok           bool
+	}{
+		{"client certificate required", "yes", []tls.Certificate{clientCert.tlsCertificate(t)}, true},
+		{"missing client certificate", "yes", nil, false},
+		{"untrusted client certificate", "yes", []tls.Certificate{untrustedCert.tlsCertificate(t)}, false},
+		{"optional without certificate", "optional", nil, true},
+		{"optional with untrusted certificate", "optional", []tls.Certificate{untrustedCert.tlsCertificate(t)}, false},
+		{"no client authentication", "no", nil, true},
+	}
+
+	for _, testCase := range testCases {
+		opts := TLSOptions{
+			CertFile:    filepath.Join(dir, "server.crt"),
+			KeyFile:     filepath.Join(dir, "server.key"),
+			CACertFile:  filepath.Join(dir, "ca.crt"),
+			AuthClients: testCase.authClients,
+		}
+		tlsConfig, err := opts.serverConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := newServer()
+		err = s.listen("tcp", "127.0.0.1:0", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := s.listeners[0].Addr().String()
+
+		clientConfig := &tls.Config{RootCAs: roots}
+		if testCase.certificates != nil {
+			// Send the certificate even when the server does not list its CA as acceptable
+			clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &testCase.certificates[0], nil
+			}
+		}
+		reply, err := tlsPing(addr, clientConfig)
+		ok := err == nil && reply == "+PONG\r\n"
+		s.Shutdown(time.Second)
+
+		if ok != testCase.ok {
+			t.Fatalf("Case \"%s\":\nExpected ok=%v\nActual ok=%v, reply=%q, err=%v", testCase.title, testCase.ok, ok, reply, err)
+		}
+	}
+}
+
+func TestTLSAndPlaintextListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atossa-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "Atossa Test CA", nil)
+	serverCert := newTestCertificate(t, "atossa", ca)
+	ioutil.WriteFile(filepath.Join(dir, "server.crt"), serverCert.certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server.key"), serverCert.keyPEM, 0600)
+
+	tlsConfig, err := TLSOptions{
+		CertFile:    filepath.Join(dir, "server.crt"),
+		KeyFile:     filepath.Join(dir, "server.key"),
+		AuthClients: "no",
+	}.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer()
+	defer s.Shutdown(time.Second)
+	err = s.listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	reply, err := tlsPing(s.listeners[1].Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil || reply != "+PONG\r\n" {
+		t.Fatalf("TLS listener: Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+	}
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("PING\r\n"))
+	reply, err = bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "+PONG\r\n" {
+		t.Fatalf("Plaintext listener: Expected reply=%q, Actual reply=%q, err=%v", "+PONG\r\n", reply, err)
+	}
+}
+
+func tlsPing(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}